@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"distributed-file-store/p2p"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultAntiEntropyInterval 是两轮反熵同步之间的默认间隔
+	defaultAntiEntropyInterval = time.Minute
+	// merkleDepth 是哈希树的深度，叶子节点按散列后的 key 的前 merkleDepth 个十六进制字符划分
+	merkleDepth = 2
+)
+
+const hexDigits = "0123456789abcdef"
+
+// MessageMerkleNodes 请求对端返回它的哈希树上一组节点的哈希值，节点用散列后的 key 的前缀表示
+// 对端的哈希树只包含它自己应该保存副本的条目
+type MessageMerkleNodes struct {
+	RequestID string
+	// Session 标识一次同步，对端在同一次同步中的请求都使用同一棵哈希树
+	Session  string
+	Prefixes []string
+}
+
+// MessageMerkleNodesResponse 是对 MessageMerkleNodes 的响应，空的子树没有哈希值
+type MessageMerkleNodesResponse struct {
+	RequestID string
+	Hashes    map[string][]byte
+}
+
+// MessageMerkleLeaves 请求对端返回哈希树上一组叶子节点中的所有条目，这是一次同步中的最后一个请求
+type MessageMerkleLeaves struct {
+	RequestID string
+	Session   string
+	Prefixes  []string
+}
+
+// MessageMerkleLeavesResponse 是对 MessageMerkleLeaves 的响应
+type MessageMerkleLeavesResponse struct {
+	RequestID string
+	Items     []SyncItem
+}
+
+// SyncItem 是反熵同步中比较的一个条目，表示一个文件的副本或者一个墓碑
+type SyncItem struct {
+	// ID 是文件所有者的 ID，Key 是散列后的 key
+	ID       string
+	Key      string
+	Checksum string
+	// Version 是写入文件或者删除文件时混合逻辑时钟的时间戳
+	Version Timestamp
+	Deleted bool
+
+	// storedKey 和 name 是本地存储中使用的 key 和文件原始的 key，不会发送给对端
+	storedKey string
+	name      string
+}
+
+// merkleTree 是由一组条目按散列后的 key 的前缀组成的哈希树
+type merkleTree struct {
+	leaves map[string][]SyncItem
+	hashes map[string][]byte
+}
+
+func newMerkleTree(items []SyncItem) *merkleTree {
+	t := &merkleTree{
+		leaves: make(map[string][]SyncItem),
+		hashes: make(map[string][]byte),
+	}
+
+	for _, item := range items {
+		prefix := item.Key[:merkleDepth]
+		t.leaves[prefix] = append(t.leaves[prefix], item)
+	}
+
+	for prefix, items := range t.leaves {
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].ID != items[j].ID {
+				return items[i].ID < items[j].ID
+			}
+			return items[i].Key < items[j].Key
+		})
+
+		h := sha256.New()
+		for _, item := range items {
+			fmt.Fprintf(h, "%s/%s/%s/%s/%t\n", item.ID, item.Key, item.Checksum, item.Version, item.Deleted)
+		}
+		t.hashes[prefix] = h.Sum(nil)
+	}
+
+	t.hash("")
+
+	return t
+}
+
+// hash 返回 prefix 对应的子树的哈希值，空的子树返回 nil
+func (t *merkleTree) hash(prefix string) []byte {
+	if h, ok := t.hashes[prefix]; ok || len(prefix) >= merkleDepth {
+		return h
+	}
+
+	h := sha256.New()
+	empty := true
+	for _, c := range hexDigits {
+		if child := t.hash(prefix + string(c)); child != nil {
+			h.Write([]byte{byte(c)})
+			h.Write(child)
+			empty = false
+		}
+	}
+
+	if empty {
+		return nil
+	}
+
+	t.hashes[prefix] = h.Sum(nil)
+	return t.hashes[prefix]
+}
+
+// shouldHold 判断 target 节点是否应该保存 id 的文件 hk 的副本
+// 文件所有者自己保存的是明文，不在同步的范围内
+func (s *FileServer) shouldHold(target string, id string, hk string) bool {
+	if target == id {
+		return false
+	}
+
+	return slices.Contains(s.ring.Owners(hk, s.ReplicationFactor), target)
+}
+
+// syncItems 返回本地所有应该由 target 节点保存副本的文件和墓碑，同一个文件只保留最新的条目
+func (s *FileServer) syncItems(target string) ([]SyncItem, error) {
+	keys, err := s.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones, err := s.store.Tombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[[2]string]SyncItem)
+	add := func(item SyncItem) {
+		// 本节点自己的文件以原始的 key 保存，副本以散列后的 key 保存
+		item.Key = item.storedKey
+		if item.ID == s.ID {
+			item.Key = hashKey(item.storedKey)
+		}
+		if len(item.Key) < merkleDepth || !s.shouldHold(target, item.ID, item.Key) {
+			return
+		}
+
+		id := [2]string{item.ID, item.Key}
+		if prev, ok := latest[id]; ok && item.Version.Compare(prev.Version) <= 0 {
+			return
+		}
+		latest[id] = item
+	}
+
+	for _, k := range keys {
+		meta, err := s.store.Metadata(k.ID, k.Key)
+		if err != nil {
+			continue
+		}
+		add(SyncItem{ID: k.ID, Checksum: meta.Checksum, Version: meta.timestamp(), storedKey: k.Key, name: k.Name})
+	}
+
+	for _, ts := range tombstones {
+		add(SyncItem{ID: ts.ID, Version: ts.DeletedAt, Deleted: true, storedKey: ts.Key})
+	}
+
+	items := make([]SyncItem, 0, len(latest))
+	for _, item := range latest {
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// antiEntropyLoop 每隔 AntiEntropyInterval 和每个已连接的对端同步一次，直到文件服务器停止
+func (s *FileServer) antiEntropyLoop() {
+	ticker := time.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.antiEntropy()
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// antiEntropy 和每个已经知道节点 ID 的对端同步一次
+func (s *FileServer) antiEntropy() {
+	s.peerLock.Lock()
+	targets := make(map[string]p2p.Peer, len(s.nodeIDs))
+	for addr, nodeID := range s.nodeIDs {
+		if peer, ok := s.peers[addr]; ok {
+			targets[nodeID] = peer
+		}
+	}
+	s.peerLock.Unlock()
+
+	for nodeID, peer := range targets {
+		if err := s.syncWith(peer, nodeID); err != nil {
+			slog.Error("anti-entropy sync failed", "remote addr", peer.RemoteAddr(), "error", err)
+		}
+	}
+}
+
+// syncWith 比较本地和对端的哈希树，从根节点开始只向下比较哈希值不同的子树，
+// 再把对端缺少的或者比本地旧的文件和墓碑推送给对端。对端缺少的数据只由持有数据的一方推送
+func (s *FileServer) syncWith(peer p2p.Peer, target string) error {
+	items, err := s.syncItems(target)
+	if err != nil {
+		return err
+	}
+	tree := newMerkleTree(items)
+	session := generateID()
+
+	differing := []string{""}
+	for depth := 0; ; depth++ {
+		resp, err := s.request(peer, func(id string) any {
+			return MessageMerkleNodes{RequestID: id, Session: session, Prefixes: differing}
+		})
+		if err != nil {
+			return err
+		}
+		remote := resp.(MessageMerkleNodesResponse).Hashes
+
+		var next []string
+		for _, prefix := range differing {
+			if bytes.Equal(tree.hash(prefix), remote[prefix]) {
+				continue
+			}
+			// 对端有而本地没有的子树由对端在它的同步中推送过来
+			if tree.hash(prefix) == nil {
+				continue
+			}
+			next = append(next, prefix)
+		}
+
+		if len(next) == 0 {
+			return nil
+		}
+		if depth == merkleDepth {
+			differing = next
+			break
+		}
+
+		differing = differing[:0]
+		for _, prefix := range next {
+			for _, c := range hexDigits {
+				differing = append(differing, prefix+string(c))
+			}
+		}
+	}
+
+	resp, err := s.request(peer, func(id string) any {
+		return MessageMerkleLeaves{RequestID: id, Session: session, Prefixes: differing}
+	})
+	if err != nil {
+		return err
+	}
+
+	remote := make(map[[2]string]SyncItem)
+	for _, item := range resp.(MessageMerkleLeavesResponse).Items {
+		remote[[2]string{item.ID, item.Key}] = item
+	}
+
+	var pushed int
+	for _, prefix := range differing {
+		for _, item := range tree.leaves[prefix] {
+			if r, ok := remote[[2]string{item.ID, item.Key}]; ok && item.Version.Compare(r.Version) <= 0 {
+				continue
+			}
+
+			if err := s.push(peer, item); err != nil {
+				return err
+			}
+			pushed++
+		}
+	}
+
+	slog.Info("anti-entropy sync finished", "remote addr", peer.RemoteAddr(), "ranges", len(differing), "pushed", pushed)
+
+	return nil
+}
+
+// push 将本地的一个文件或者墓碑推送给对端
+func (s *FileServer) push(peer p2p.Peer, item SyncItem) error {
+	if item.Deleted {
+		return s.send(peer, &Message{
+			Payload: MessageDeleteFile{
+				ID:        item.ID,
+				Key:       item.Key,
+				DeletedAt: item.Version,
+			},
+		})
+	}
+
+	// 本节点自己的文件需要先加密
+	if item.ID == s.ID {
+		return s.replicate(item.storedKey, []p2p.Peer{peer})
+	}
+
+	// 其他节点的副本原样发送
+	size, r, meta, err := s.store.ReadWithMetadata(item.ID, item.storedKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	msg := MessageStoreFile{
+		ID:       item.ID,
+		Key:      item.storedKey,
+		Size:     size,
+		Name:     item.name,
+		Metadata: meta,
+	}
+
+	return s.sendStream(peer, msg, r)
+}
+
+// request 向对端发送一个请求并等待它的响应，newMsg 根据请求 ID 创建请求消息
+func (s *FileServer) request(peer p2p.Peer, newMsg func(requestID string) any) (any, error) {
+	req := s.addPendingRequest(1)
+	defer s.removePendingRequest(req)
+
+	if err := s.send(peer, &Message{Payload: newMsg(req.id)}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-req.respCh:
+		return resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("[%s] timed out waiting for response from (%s)", s.Transport.Addr(), peer.RemoteAddr())
+	case <-s.quitCh:
+		return nil, fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+	}
+}
+
+// localTree 返回本地应该由本节点自己保存副本的条目组成的哈希树
+func (s *FileServer) localTree() (*merkleTree, error) {
+	items, err := s.syncItems(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMerkleTree(items), nil
+}
+
+// sessionTree 是一次同步中使用的本地哈希树
+type sessionTree struct {
+	tree    *merkleTree
+	expires time.Time
+}
+
+// sessionTree 返回对端的一次同步使用的本地哈希树。第一个请求到达时扫描本地存储建立哈希树，
+// 之后的请求直接使用它。对端没有发送最后一个请求时，哈希树在同步可能用完的时间之后丢弃
+func (s *FileServer) sessionTree(from string, session string) (*merkleTree, error) {
+	id := [2]string{from, session}
+	now := time.Now()
+
+	s.treeLock.Lock()
+	for k, t := range s.trees {
+		if now.After(t.expires) {
+			delete(s.trees, k)
+		}
+	}
+	cached, ok := s.trees[id]
+	s.treeLock.Unlock()
+
+	if ok {
+		return cached.tree, nil
+	}
+
+	tree, err := s.localTree()
+	if err != nil {
+		return nil, err
+	}
+
+	s.treeLock.Lock()
+	s.trees[id] = &sessionTree{tree: tree, expires: now.Add((merkleDepth + 2) * s.RequestTimeout)}
+	s.treeLock.Unlock()
+
+	return tree, nil
+}
+
+// endSession 丢弃对端的一次同步使用的哈希树
+func (s *FileServer) endSession(from string, session string) {
+	s.treeLock.Lock()
+	defer s.treeLock.Unlock()
+
+	delete(s.trees, [2]string{from, session})
+}
+
+// handleMessageMerkleNodes 在后台建立哈希树并响应，扫描本地存储不阻塞其他的消息
+func (s *FileServer) handleMessageMerkleNodes(from string, msg MessageMerkleNodes) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	go func() {
+		tree, err := s.sessionTree(from, msg.Session)
+		if err != nil {
+			slog.Error("failed to build merkle tree", "peer", from, "error", err)
+			return
+		}
+
+		resp := MessageMerkleNodesResponse{
+			RequestID: msg.RequestID,
+			Hashes:    make(map[string][]byte, len(msg.Prefixes)),
+		}
+		for _, prefix := range msg.Prefixes {
+			if h := tree.hash(prefix); h != nil {
+				resp.Hashes[prefix] = h
+			}
+		}
+
+		if err := s.send(peer, &Message{Payload: resp}); err != nil {
+			slog.Error("failed to send merkle nodes", "peer", from, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *FileServer) handleMessageMerkleNodesResponse(from string, msg MessageMerkleNodesResponse) error {
+	if req, ok := s.pendingRequest(msg.RequestID); ok {
+		req.deliver(msg)
+	}
+
+	return nil
+}
+
+// handleMessageMerkleLeaves 在后台响应，同步结束后丢弃这次同步使用的哈希树
+func (s *FileServer) handleMessageMerkleLeaves(from string, msg MessageMerkleLeaves) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	go func() {
+		tree, err := s.sessionTree(from, msg.Session)
+		s.endSession(from, msg.Session)
+		if err != nil {
+			slog.Error("failed to build merkle tree", "peer", from, "error", err)
+			return
+		}
+
+		resp := MessageMerkleLeavesResponse{RequestID: msg.RequestID}
+		for _, prefix := range msg.Prefixes {
+			resp.Items = append(resp.Items, tree.leaves[prefix]...)
+		}
+
+		if err := s.send(peer, &Message{Payload: resp}); err != nil {
+			slog.Error("failed to send merkle leaves", "peer", from, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *FileServer) handleMessageMerkleLeavesResponse(from string, msg MessageMerkleLeavesResponse) error {
+	if req, ok := s.pendingRequest(msg.RequestID); ok {
+		req.deliver(msg)
+	}
+
+	return nil
+}
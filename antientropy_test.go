@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"distributed-file-store/p2p"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleTree(t *testing.T) {
+	now := NewHLC("owner").Now()
+
+	var items []SyncItem
+	for i := range 100 {
+		items = append(items, SyncItem{ID: "owner", Key: hashKey(string(rune('a' + i))), Version: now})
+	}
+
+	assert.Nil(t, newMerkleTree(nil).hash(""))
+
+	a, b := newMerkleTree(items), newMerkleTree(items)
+	assert.Equal(t, a.hash(""), b.hash(""))
+
+	// 只修改一个条目，只有它所在的叶子和通往根节点的路径上的哈希值不同
+	changed := append([]SyncItem(nil), items...)
+	changed[42].Version.Logical++
+	c := newMerkleTree(changed)
+	assert.NotEqual(t, a.hash(""), c.hash(""))
+
+	var differing []string
+	for prefix := range a.leaves {
+		if !bytes.Equal(a.hash(prefix), c.hash(prefix)) {
+			differing = append(differing, prefix)
+		}
+	}
+	assert.Equal(t, []string{changed[42].Key[:merkleDepth]}, differing)
+}
+
+func TestAntiEntropyRepairsReplicas(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30951", withNodes("127.0.0.1:30952"))
+	b := makeTestServer(t, "127.0.0.1:30952")
+
+	startCluster(t, b, a)
+
+	key := "backups/db.dump"
+	hk := hashKey(key)
+	assert.Nil(t, a.Store(key, strings.NewReader("database snapshot")))
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hk)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// c 在写入的时候还不在线，同步之后从 a 和 b 得到副本
+	c := makeTestServer(t, "127.0.0.1:30953", withNodes("127.0.0.1:30951", "127.0.0.1:30952"))
+	startServers(t, c)
+
+	assert.Eventually(t, func() bool {
+		return a.ring.Len() == 3 && b.ring.Len() == 3 && c.ring.Len() == 3
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.False(t, c.store.Has(a.ID, hk))
+
+	a.antiEntropy()
+	assert.Eventually(t, func() bool {
+		return c.store.Has(a.ID, hk)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	meta, err := c.store.Metadata(a.ID, hk)
+	assert.Nil(t, err)
+	want, _ := a.store.Metadata(a.ID, key)
+	assert.Equal(t, want.Checksum, meta.Checksum)
+
+	// 已经一致的副本之间不需要推送任何数据
+	items, err := b.syncItems(c.ID)
+	assert.Nil(t, err)
+	remote, err := c.syncItems(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, newMerkleTree(items).hash(""), newMerkleTree(remote).hash(""))
+
+	// 删除之后，模拟 c 错过了这次删除，仍然保留着旧的副本
+	assert.Nil(t, a.Delete(key))
+	forgetTombstone(t, c.store, a.ID, hk)
+	_, err = c.store.WriteFull(a.ID, hk, key, strings.NewReader("stale"), 5, want)
+	assert.Nil(t, err)
+
+	// c 推送旧的副本时会被 b 的墓碑拒绝
+	c.antiEntropy()
+	b.antiEntropy()
+
+	assert.Eventually(t, func() bool {
+		_, deleted := c.store.Tombstone(a.ID, hk)
+		return deleted && !c.store.Has(a.ID, hk)
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.False(t, b.store.Has(a.ID, hk))
+}
+
+func TestSessionTree(t *testing.T) {
+	s := makeTestServer(t, "a", onNetwork(p2p.NewMemNetwork(1)))
+
+	// 同一次同步中的请求只扫描一次本地存储
+	tree, err := s.sessionTree("b", "sync")
+	assert.Nil(t, err)
+	again, err := s.sessionTree("b", "sync")
+	assert.Nil(t, err)
+	assert.Same(t, tree, again)
+
+	// 不同的同步各自建立哈希树
+	other, err := s.sessionTree("c", "sync")
+	assert.Nil(t, err)
+	assert.NotSame(t, tree, other)
+
+	// 同步结束之后丢弃
+	s.endSession("b", "sync")
+	again, err = s.sessionTree("b", "sync")
+	assert.Nil(t, err)
+	assert.NotSame(t, tree, again)
+
+	// 超时的哈希树在之后的请求中被清理
+	s.trees[[2]string{"c", "sync"}].expires = time.Now().Add(-time.Second)
+	_, err = s.sessionTree("b", "sync")
+	assert.Nil(t, err)
+	assert.NotContains(t, s.trees, [2]string{"c", "sync"})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend 是 Store 底层的存储介质，文件名是以 "/" 分隔的相对路径
+type Backend interface {
+	// Open 打开一个文件用于读取，文件不存在时返回的错误满足 errors.Is(err, fs.ErrNotExist)
+	Open(name string) (fs.File, error)
+	// Create 创建一个文件用于写入，写入的数据在 Commit 之后才会替换原来的文件
+	Create(name string) (BackendWriter, error)
+	// Stat 返回文件的信息
+	Stat(name string) (fs.FileInfo, error)
+	// Remove 删除一个文件
+	Remove(name string) error
+	// Walk 按字典序遍历 dir 下面的所有文件，dir 不存在时不会返回错误
+	Walk(dir string, fn func(name string, info fs.FileInfo) error) error
+}
+
+// BackendWriter 是 Backend.Create 返回的 writer
+// 调用 Commit 之前写入的数据对读取不可见，Abort 丢弃已经写入的数据
+type BackendWriter interface {
+	io.Writer
+	Commit() error
+	Abort() error
+}
+
+// FSBackend 将文件保存在本地文件系统的 root 目录下
+type FSBackend struct {
+	root string
+}
+
+// NewFSBackend 创建一个新的文件系统后端
+func NewFSBackend(root string) *FSBackend {
+	return &FSBackend{root: root}
+}
+
+func (b *FSBackend) path(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+func (b *FSBackend) Open(name string) (fs.File, error) {
+	return os.Open(b.path(name))
+}
+
+func (b *FSBackend) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(b.path(name))
+}
+
+// Create 将数据写入同一目录下的临时文件，Commit 时 fsync 并 rename 到最终路径，
+// 这样崩溃或者中途失败都不会留下不完整的文件
+func (b *FSBackend) Create(name string) (BackendWriter, error) {
+	fullPath := b.path(name)
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fullPath), "."+filepath.Base(fullPath)+tempFileInfix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsWriter{File: f, path: fullPath}, nil
+}
+
+// Remove 删除一个文件，并删除因此变空的父目录
+// 第一层目录（Store 中每个 ID 的命名空间）会被保留
+func (b *FSBackend) Remove(name string) error {
+	fullPath := b.path(name)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+
+	top, _, _ := strings.Cut(path.Clean(name), "/")
+	return pruneEmptyDirs(filepath.Dir(fullPath), b.path(top))
+}
+
+func (b *FSBackend) Walk(dir string, fn func(name string, info fs.FileInfo) error) error {
+	err := filepath.WalkDir(b.path(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+
+		return fn(filepath.ToSlash(rel), info)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// pruneEmptyDirs 从 dir 开始向上删除空目录，遇到非空目录或者到达 stop 时停止，stop 本身不会被删除
+func pruneEmptyDirs(dir string, stop string) error {
+	dir, stop = filepath.Clean(dir), filepath.Clean(stop)
+
+	for dir != stop && strings.HasPrefix(dir, stop+string(filepath.Separator)) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+
+		dir = filepath.Dir(dir)
+	}
+
+	return nil
+}
+
+type fsWriter struct {
+	*os.File
+	path string
+}
+
+func (w *fsWriter) Commit() error {
+	err := w.Sync()
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+
+	return syncDir(filepath.Dir(w.path))
+}
+
+func (w *fsWriter) Abort() error {
+	w.Close()
+	return os.Remove(w.Name())
+}
+
+// syncDir 将目录项的修改落盘，保证 rename 之后的文件在崩溃后依然存在
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// MemoryBackend 将文件保存在内存中，主要用于测试
+type MemoryBackend struct {
+	mu    sync.RWMutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryBackend 创建一个新的内存后端
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		files: make(map[string]*memFile),
+	}
+}
+
+func (b *MemoryBackend) file(op string, name string) (string, *memFile, error) {
+	name = path.Clean(name)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	f, ok := b.files[name]
+	if !ok {
+		return name, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return name, f, nil
+}
+
+func (b *MemoryBackend) Open(name string) (fs.File, error) {
+	name, f, err := b.file("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	// 已经提交的数据不会再被修改，读取时不需要复制
+	return &memReader{
+		Reader: bytes.NewReader(f.data),
+		info:   memFileInfo{name: path.Base(name), size: int64(len(f.data)), modTime: f.modTime},
+	}, nil
+}
+
+func (b *MemoryBackend) Stat(name string) (fs.FileInfo, error) {
+	name, f, err := b.file("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return memFileInfo{name: path.Base(name), size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+func (b *MemoryBackend) Create(name string) (BackendWriter, error) {
+	return &memWriter{backend: b, name: path.Clean(name)}, nil
+}
+
+func (b *MemoryBackend) Remove(name string) error {
+	name = path.Clean(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(b.files, name)
+
+	return nil
+}
+
+func (b *MemoryBackend) Walk(dir string, fn func(name string, info fs.FileInfo) error) error {
+	prefix := path.Clean(dir) + "/"
+	if prefix == "./" {
+		prefix = ""
+	}
+
+	b.mu.RLock()
+	var names []string
+	infos := make(map[string]fs.FileInfo)
+	for name, f := range b.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+			infos[name] = memFileInfo{name: path.Base(name), size: int64(len(f.data)), modTime: f.modTime}
+		}
+	}
+	b.mu.RUnlock()
+
+	// 回调中可能会修改后端，所以在锁外调用
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name, infos[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type memWriter struct {
+	backend *MemoryBackend
+	name    string
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fs.ErrClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Commit() error {
+	if w.done {
+		return fs.ErrClosed
+	}
+	w.done = true
+
+	w.backend.mu.Lock()
+	defer w.backend.mu.Unlock()
+
+	w.backend.files[w.name] = &memFile{data: w.buf.Bytes(), modTime: time.Now()}
+	return nil
+}
+
+func (w *memWriter) Abort() error {
+	w.done = true
+	w.buf = bytes.Buffer{}
+	return nil
+}
+
+type memReader struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (r *memReader) Stat() (fs.FileInfo, error) { return r.info, nil }
+func (r *memReader) Close() error               { return nil }
+
+// memFileInfo 实现了 fs.FileInfo 接口
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
+
+var (
+	_ Backend = (*FSBackend)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+)
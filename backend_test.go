@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"fs":     func(t *testing.T) Backend { return NewFSBackend(t.TempDir()) },
+		"memory": func(t *testing.T) Backend { return NewMemoryBackend() },
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			testBackend(t, newBackend(t))
+		})
+	}
+}
+
+func testBackend(t *testing.T, b Backend) {
+	write := func(name string, data string) {
+		w, err := b.Create(name)
+		assert.Nil(t, err)
+		_, err = io.WriteString(w, data)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Commit())
+	}
+
+	read := func(name string) string {
+		f, err := b.Open(name)
+		assert.Nil(t, err)
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	_, err := b.Open("id/a/missing")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	write("id/a/one", "one")
+	write("id/b/two", "two")
+	write("other/three", "three")
+	assert.Equal(t, "one", read("id/a/one"))
+
+	info, err := b.Stat("id/b/two")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), info.Size())
+
+	// 没有提交的数据不可见，被丢弃的写入不影响原来的文件
+	w, err := b.Create("id/a/one")
+	assert.Nil(t, err)
+	io.WriteString(w, "uncommitted")
+	assert.Equal(t, "one", read("id/a/one"))
+	assert.Nil(t, w.Abort())
+	assert.Equal(t, "one", read("id/a/one"))
+
+	write("id/a/one", "replaced")
+	assert.Equal(t, "replaced", read("id/a/one"))
+
+	var names []string
+	assert.Nil(t, b.Walk("id", func(name string, info fs.FileInfo) error {
+		names = append(names, name)
+		return nil
+	}))
+	assert.Equal(t, []string{"id/a/one", "id/b/two"}, names)
+
+	assert.Nil(t, b.Walk("missing", func(string, fs.FileInfo) error {
+		t.Error("walked a missing directory")
+		return nil
+	}))
+
+	assert.Nil(t, b.Remove("id/a/one"))
+	_, err = b.Stat("id/a/one")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.True(t, errors.Is(b.Remove("id/a/one"), fs.ErrNotExist))
+	assert.Equal(t, "two", read("id/b/two"))
+}
+
+func TestStoreWithMemoryBackend(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+	})
+	id := generateID()
+	key := "picture.png"
+
+	_, err := s.Write(id, key, &failingReader{data: []byte("partial")})
+	assert.NotNil(t, err)
+	assert.False(t, s.Has(id, key))
+
+	assert.Nil(t, s.WriteTombstone(id, key, NewHLC(id).Now()))
+	_, deleted := s.Tombstone(id, key)
+	assert.True(t, deleted)
+
+	n, err := s.Write(id, key, strings.NewReader("content"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), n)
+
+	// 重新写入后墓碑被清除
+	_, deleted = s.Tombstone(id, key)
+	assert.False(t, deleted)
+
+	size, err := s.Stat(id, key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), size)
+
+	assert.Nil(t, s.Delete(id, key))
+	assert.True(t, errors.Is(s.Delete(id, key), fs.ErrNotExist))
+}
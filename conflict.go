@@ -0,0 +1,134 @@
+package main
+
+import "slices"
+
+// ConflictResolver 从并发写入的一组版本中选出一个作为当前的版本，返回它的版本 ID，
+// versions 从新到旧排列。返回的版本 ID 不在 versions 中时，这些版本都保留为当前的版本。
+// 每个副本独立地解决冲突，因此 ConflictResolver 对同样的输入应该返回同样的结果。
+// 并发的版本只出现在同一个命名空间中：每个节点的文件保存在它自己的 ID 下，不同节点写入同名的 key 不会冲突，
+// 冲突来自同一个节点上并发的 StoreWithMetadata，或者使用同一个 Identity 的多个节点
+type ConflictResolver func(versions []VersionInfo) string
+
+// LastWriterWins 是一个 ConflictResolver，选出混合逻辑时钟最新的版本
+func LastWriterWins(versions []VersionInfo) string {
+	return versions[0].VersionID
+}
+
+// placement 是一个版本加入 sidecar 之后各个版本的位置
+type placement struct {
+	// heads 是当前的版本和与它并发的版本
+	heads []objectVersion
+	// history 是被取代的旧版本
+	history []objectVersion
+	// dropped 是被相同的版本替换掉的版本，它们的数据文件需要删除
+	dropped []objectVersion
+	// stale 表示新的版本已经被当前的版本取代，被加入了 history
+	stale bool
+}
+
+// place 计算版本 v 加入 sidecar 之后各个版本的位置。
+// v 的 Parents 中能追溯到的版本是它的祖先，被 v 取代；v 是当前版本的祖先时，v 已经过时；
+// 两者都不是时它们是并发写入的。无法判断时，比如缺少版本 ID 或者 Parents，或者中间的版本没有保留，按照版本的先后取代
+func (sc sidecar) place(v objectVersion) placement {
+	known := make(map[string]objectVersion)
+	for _, o := range sc.versions() {
+		if len(o.VersionID) > 0 {
+			known[o.VersionID] = o
+		}
+	}
+
+	p := placement{history: sc.History}
+	var kept, superseded []objectVersion
+	for _, h := range sc.heads() {
+		if h.sameVersion(v.Metadata) {
+			p.dropped = append(p.dropped, h)
+			continue
+		}
+
+		descendant, vComplete := descends(known, v, h.VersionID)
+		ancestor, hComplete := descends(known, h, v.VersionID)
+		certain := vComplete && hComplete && len(v.VersionID) > 0 && len(h.VersionID) > 0 &&
+			len(v.Parents) > 0 && len(h.Parents) > 0
+
+		switch {
+		case descendant:
+			superseded = append(superseded, h)
+		case ancestor:
+			p.stale = true
+		case !certain && v.newerThan(h.Metadata):
+			superseded = append(superseded, h)
+		case !certain:
+			p.stale = true
+		default:
+			kept = append(kept, h)
+		}
+	}
+
+	// 过时的版本只作为旧版本保留，不取代任何版本
+	if p.stale {
+		p.heads = slices.DeleteFunc(sc.heads(), func(h objectVersion) bool { return h.sameVersion(v.Metadata) })
+		p.history = append(slices.Clone(p.history), v)
+		return p
+	}
+
+	p.heads = append(kept, v)
+	p.history = append(slices.Clone(p.history), superseded...)
+	return p
+}
+
+// descends 判断 ancestor 是否能从 v 的 Parents 沿着已知版本的 Parents 追溯到，
+// complete 表示追溯过程中遇到的版本都是已知的，为 false 时结果可能不准确
+func descends(known map[string]objectVersion, v objectVersion, ancestor string) (found bool, complete bool) {
+	complete = true
+	visited := make(map[string]bool)
+	queue := slices.Clone(v.Parents)
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		if id == ancestor {
+			return true, complete
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+
+		parent, ok := known[id]
+		if !ok {
+			complete = false
+			continue
+		}
+		queue = append(queue, parent.Parents...)
+	}
+
+	return false, complete
+}
+
+// resolve 用 Resolver 从并发的版本中选出当前的版本，其他版本成为旧版本，heads 从新到旧排列
+func (s *Store) resolve(heads, history []objectVersion) ([]objectVersion, []objectVersion) {
+	infos := make([]VersionInfo, 0, len(heads))
+	for _, h := range heads {
+		infos = append(infos, VersionInfo{
+			VersionID: h.VersionID,
+			Size:      h.Size,
+			Checksum:  h.Checksum,
+			CreatedAt: h.CreatedAt,
+		})
+	}
+
+	winner := s.Resolver(infos)
+	i := slices.IndexFunc(heads, func(h objectVersion) bool { return h.VersionID == winner })
+	if i < 0 {
+		return heads, history
+	}
+
+	for j, h := range heads {
+		if j != i {
+			history = append(history, h)
+		}
+	}
+
+	return heads[i : i+1], history
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"distributed-file-store/p2p"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreConflicts(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+		MaxVersions:       defaultMaxVersions,
+	})
+	id := generateID()
+	key := "notes.txt"
+
+	start := time.Now()
+	meta := func(i int, parents ...string) Metadata {
+		ts := Timestamp{Wall: start.Add(time.Duration(i) * time.Second).UnixNano(), Node: id}
+		return Metadata{CreatedAt: ts.Time(), VersionID: ts.String(), Parents: parents}
+	}
+	write := func(data string, m Metadata) {
+		_, err := s.WriteWithMetadata(id, key, strings.NewReader(data), m)
+		assert.Nil(t, err)
+	}
+
+	v1 := meta(1)
+	write("v1", v1)
+
+	// 两个节点都在 v1 的基础上写入，它们是并发的，都保留为当前的版本
+	a, b := meta(2, v1.VersionID), meta(3, v1.VersionID)
+	write("a", a)
+	write("b", b)
+
+	got, err := s.Metadata(id, key)
+	assert.Nil(t, err)
+	assert.Equal(t, b.VersionID, got.VersionID)
+	assert.Equal(t, []string{a.VersionID}, got.Siblings)
+
+	_, rc, got, err := s.ReadVersion(id, key, a.VersionID)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "a", string(data))
+	assert.Equal(t, []string{b.VersionID}, got.Siblings)
+
+	versions, err := s.Versions(id, key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.True(t, versions[0].Latest)
+	assert.True(t, versions[1].Sibling)
+	assert.False(t, versions[2].Sibling)
+
+	// 已经被取代的版本再次到达时是过时的，只在其中一个版本的基础上写入的版本不是
+	assert.True(t, s.Stale(id, key, v1))
+	assert.False(t, s.Stale(id, key, meta(4, a.VersionID)))
+
+	// 看到了两个版本的写入解决冲突
+	c := meta(4, a.VersionID, b.VersionID)
+	write("c", c)
+
+	got, err = s.Metadata(id, key)
+	assert.Nil(t, err)
+	assert.Equal(t, c.VersionID, got.VersionID)
+	assert.Empty(t, got.Siblings)
+
+	versions, err = s.Versions(id, key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 4)
+
+	// 没有因果关系的信息时按照版本的先后取代
+	write("d", meta(5))
+	got, err = s.Metadata(id, key)
+	assert.Nil(t, err)
+	assert.Equal(t, meta(5).VersionID, got.VersionID)
+	assert.Empty(t, got.Siblings)
+}
+
+func TestStoreConflictResolver(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+		MaxVersions:       3,
+		Resolver:          LastWriterWins,
+	})
+	id := generateID()
+	key := "notes.txt"
+
+	start := time.Now()
+	meta := func(i int, parents ...string) Metadata {
+		ts := Timestamp{Wall: start.Add(time.Duration(i) * time.Second).UnixNano(), Node: id}
+		return Metadata{CreatedAt: ts.Time(), VersionID: ts.String(), Parents: parents}
+	}
+
+	v1 := meta(1)
+	for i, m := range []Metadata{v1, meta(3, v1.VersionID), meta(2, v1.VersionID)} {
+		_, err := s.WriteWithMetadata(id, key, strings.NewReader(string(rune('a'+i))), m)
+		assert.Nil(t, err)
+	}
+
+	got, err := s.Metadata(id, key)
+	assert.Nil(t, err)
+	assert.Equal(t, meta(3).VersionID, got.VersionID)
+	assert.Empty(t, got.Siblings)
+
+	// 落选的版本作为旧版本保留
+	assert.True(t, s.HasVersion(id, key, meta(2).VersionID))
+}
+
+func TestConcurrentStore(t *testing.T) {
+	// a1 和 a2 使用同一个身份和密钥，它们对同一个 key 的写入在同一个命名空间中，会到达同一个副本
+	identity, err := p2p.NewIdentity()
+	assert.Nil(t, err)
+	encKey := newEncryptionKey()
+	shared := []testServerOption{
+		withIdentity(identity, nil),
+		withNodes("127.0.0.1:30993"),
+		withOpts(func(opts *FileServerOpts) {
+			opts.EncKey = encKey
+			opts.ReplicationFactor = 2
+			opts.WriteQuorum = 2
+		}),
+	}
+	a1, a2 := makeTestServer(t, "127.0.0.1:30991", shared...), makeTestServer(t, "127.0.0.1:30992", shared...)
+	r := makeTestServer(t, "127.0.0.1:30993")
+	assert.Equal(t, a1.ID, a2.ID)
+
+	startServers(t, r, a1, a2)
+
+	assert.Eventually(t, func() bool {
+		return a1.ring.Len() == 2 && a2.ring.Len() == 2 && numPeers(r) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	key := "shared.txt"
+	v1, err := a1.StoreWithMetadata(key, strings.NewReader("v1"), Metadata{})
+	assert.Nil(t, err)
+
+	// a2 读取之后和 a1 有了共同的版本
+	rc, _, err := a2.Get(key)
+	assert.Nil(t, err)
+	rc.(io.Closer).Close()
+
+	va, err := a1.StoreWithMetadata(key, strings.NewReader("from a1"), Metadata{})
+	assert.Nil(t, err)
+	vb, err := a2.StoreWithMetadata(key, strings.NewReader("from a2"), Metadata{})
+	assert.Nil(t, err)
+
+	// 两个写入都以 v1 为基础，副本把它们都保留下来
+	meta, err := r.store.Metadata(a1.ID, hashKey(key))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{va, vb}, append([]string{meta.VersionID}, meta.Siblings...))
+	assert.True(t, r.store.HasVersion(a1.ID, hashKey(key), v1))
+
+	// 比较副本的读取会返回冲突的版本
+	a1.ReadQuorum = 2
+	rc, meta, err = a1.Get(key)
+	assert.Nil(t, err)
+	rc.(io.Closer).Close()
+	assert.Equal(t, vb, meta.VersionID)
+	assert.Equal(t, []string{va}, meta.Siblings)
+}
+
+// gatedReader 在第一次读取时关闭 started，然后等到 release 被关闭之后才开始返回数据
+type gatedReader struct {
+	r       io.Reader
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedReader) Read(b []byte) (int, error) {
+	g.once.Do(func() { close(g.started) })
+	<-g.release
+	return g.r.Read(b)
+}
+
+func TestConcurrentStoreOnOneNode(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("r"))
+	r := makeTestServer(t, "r", onNetwork(network))
+	a.WriteQuorum = 2
+
+	startCluster(t, r, a)
+
+	key := "concurrent.txt"
+	v1, err := a.StoreWithMetadata(key, strings.NewReader("v1"), Metadata{})
+	assert.Nil(t, err)
+
+	// 第一个写入已经选定了它的父版本 v1，还没有写完时第二个写入开始，两者都以 v1 为基础
+	slow := &gatedReader{r: strings.NewReader("slow"), started: make(chan struct{}), release: make(chan struct{})}
+	type result struct {
+		versionID string
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		versionID, err := a.StoreWithMetadata(key, slow, Metadata{})
+		done <- result{versionID, err}
+	}()
+	<-slow.started
+
+	fast, err := a.StoreWithMetadata(key, strings.NewReader("fast"), Metadata{})
+	assert.Nil(t, err)
+	close(slow.release)
+	res := <-done
+	assert.Nil(t, res.err)
+
+	// 本地和副本都把两个并发的版本保留为当前的版本
+	for _, meta := range []func() (Metadata, error){
+		func() (Metadata, error) { return a.store.Metadata(a.ID, key) },
+		func() (Metadata, error) { return r.store.Metadata(a.ID, hashKey(key)) },
+	} {
+		got, err := meta()
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{fast, res.versionID}, append([]string{got.VersionID}, got.Siblings...))
+	}
+	assert.True(t, r.store.HasVersion(a.ID, hashKey(key), v1))
+
+	rc, meta, err := a.Get(key)
+	assert.Nil(t, err)
+	rc.(io.Closer).Close()
+	// 版本 ID 在写入开始时生成，后开始的写入排在前面
+	assert.Equal(t, fast, meta.VersionID)
+	assert.Equal(t, []string{res.versionID}, meta.Siblings)
+
+	// 看到了两个版本之后的写入解决冲突
+	_, err = a.StoreWithMetadata(key, strings.NewReader("merged"), Metadata{})
+	assert.Nil(t, err)
+	_, meta, err = a.Get(key)
+	assert.Nil(t, err)
+	assert.Empty(t, meta.Siblings)
+}
@@ -1,12 +1,39 @@
 package main
 
 import (
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+)
+
+// 加密流的格式:
+//
+//	header:  version(1) | noncePrefix(7)
+//	segment: AES-GCM(明文分段)，每段明文 segmentSize 字节，最后一段可以更短(也可以为空)
+//
+// 每段的 nonce 为 noncePrefix(7) | 段序号(4, 大端) | 是否最后一段(1)，
+// 因此篡改、截断或者调换分段的顺序都会导致解密失败
+const (
+	streamVersion    = 0x1
+	noncePrefixSize  = 7
+	streamHeaderSize = 1 + noncePrefixSize
+	segmentSize      = 64 * 1024
+	segmentTagSize   = 16
+)
+
+var (
+	// ErrUnsupportedStreamVersion 表示加密流的版本无法识别
+	ErrUnsupportedStreamVersion = errors.New("unsupported encrypted stream version")
+	// ErrStreamAuthentication 表示加密流被篡改、截断或者分段顺序被打乱
+	ErrStreamAuthentication = errors.New("encrypted stream failed authentication")
 )
 
 // generateID 生成一个随机的 ID
@@ -29,65 +56,162 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-// copyStream 从 src 中读取数据，加密后写入到 dst 中
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
-	var (
-		buf = make([]byte, 32*1024)
-		nw  = blockSize
-	)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			nn, err := dst.Write(buf[:n])
-			if err != nil {
-				return 0, err
-			}
-			nw += nn
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return 0, err
-		}
+// encryptedSize 返回 size 字节的明文经过 copyEncrypt 之后的长度
+func encryptedSize(size int64) int64 {
+	segments := (size + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		// 空文件也会有一个空的最后一段
+		segments = 1
 	}
-	return nw, nil
+	return streamHeaderSize + size + segments*segmentTagSize
 }
 
-// copyDecrypt 从 src 中读取数据，解密后写入到 dst 中
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+// decryptedSize 是 encryptedSize 的逆运算，返回长度为 size 的加密流中明文的长度
+func decryptedSize(size int64) (int64, error) {
+	body := size - streamHeaderSize
+	if body < segmentTagSize {
+		return 0, fmt.Errorf("%w: %d bytes is too short", ErrStreamAuthentication, size)
+	}
+
+	full, rem := body/(segmentSize+segmentTagSize), body%(segmentSize+segmentTagSize)
+	if rem == 0 {
+		return full * segmentSize, nil
+	}
+	if rem < segmentTagSize {
+		return 0, fmt.Errorf("%w: %d bytes is not a valid stream length", ErrStreamAuthentication, size)
+	}
+
+	return full*segmentSize + rem - segmentTagSize, nil
+}
+
+// segmentNonce 计算第 counter 段的 nonce
+func segmentNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readSegment 从 r 中读取最多 len(buf) 字节，并判断这是不是流中的最后一段
+func readSegment(r *bufio.Reader, buf []byte) (n int, final bool, err error) {
+	n, err = io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+
+	// 读满了一段，再看一下后面还有没有数据
+	if _, err := r.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
 	}
 
-	// 从给定的 io.Reader 读取 IV，在示例中，它应该是读取的块.BlockSize()字节
-	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	return n, false, nil
+}
+
+// copyDecrypt 从 src 中读取加密流，验证并解密后写入到 dst 中，返回写入的明文长度
+func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	aead, err := newGCM(key)
+	if err != nil {
 		return 0, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return 0, fmt.Errorf("%w: reading header: %v", ErrStreamAuthentication, err)
+	}
+	if header[0] != streamVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedStreamVersion, header[0])
+	}
+	prefix := header[1:]
+
+	var (
+		r   = bufio.NewReaderSize(src, segmentSize+segmentTagSize)
+		buf = make([]byte, segmentSize+segmentTagSize)
+		nw  int
+	)
+	for counter := uint32(0); ; counter++ {
+		n, final, err := readSegment(r, buf)
+		if err != nil {
+			return nw, err
+		}
+
+		plain, err := aead.Open(buf[:0], segmentNonce(prefix, counter, final), buf[:n], header)
+		if err != nil {
+			return nw, fmt.Errorf("%w: segment %d", ErrStreamAuthentication, counter)
+		}
+
+		nn, err := dst.Write(plain)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if final {
+			return nw, nil
+		}
+		if counter == math.MaxUint32 {
+			return nw, fmt.Errorf("%w: too many segments", ErrStreamAuthentication)
+		}
+	}
 }
 
+// copyEncrypt 从 src 中读取数据，分段加密后写入到 dst 中，返回写入 dst 的总长度
 func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+	aead, err := newGCM(key)
 	if err != nil {
 		return 0, err
 	}
 
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	header := make([]byte, streamHeaderSize)
+	header[0] = streamVersion
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
 		return 0, err
 	}
+	prefix := header[1:]
 
-	// 在 dst 中写入 IV，这样我们就可以在解密时读取它
-	if _, err := dst.Write(iv); err != nil {
-		return 0, err
+	// 在 dst 中写入头部，这样我们就可以在解密时读取它
+	nw, err := dst.Write(header)
+	if err != nil {
+		return nw, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+	var (
+		r   = bufio.NewReaderSize(src, segmentSize)
+		buf = make([]byte, segmentSize, segmentSize+segmentTagSize)
+	)
+	for counter := uint32(0); ; counter++ {
+		n, final, err := readSegment(r, buf[:segmentSize])
+		if err != nil {
+			return nw, err
+		}
+		if !final && counter == math.MaxUint32 {
+			return nw, errors.New("encrypted stream too long")
+		}
+
+		sealed := aead.Seal(buf[:0], segmentNonce(prefix, counter, final), buf[:n], header)
+		nn, err := dst.Write(sealed)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if final {
+			return nw, nil
+		}
+	}
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"testing"
 )
 
@@ -12,19 +15,83 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	src := bytes.NewReader([]byte(payload))
 	dst := new(bytes.Buffer)
 	key := newEncryptionKey()
-	_, err := copyEncrypt(key, src, dst)
+	nw, err := copyEncrypt(key, src, dst)
 	assert.Nil(t, err)
-
-	fmt.Println(len(payload))
-	fmt.Println(len(dst.String()))
+	assert.Equal(t, int64(nw), encryptedSize(int64(len(payload))))
+	assert.Equal(t, dst.Len(), nw)
 
 	out := new(bytes.Buffer)
-	nw, err := copyDecrypt(key, dst, out)
+	nr, err := copyDecrypt(key, dst, out)
 	assert.Nil(t, err)
-	assert.Equal(t, nw, 16+len(payload))
+	assert.Equal(t, nr, len(payload))
 	assert.Equal(t, out.String(), payload)
 }
 
+func TestCopyEncryptDecryptSizes(t *testing.T) {
+	key := newEncryptionKey()
+
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 7} {
+		payload := make([]byte, size)
+		io.ReadFull(rand.Reader, payload)
+
+		enc := new(bytes.Buffer)
+		nw, err := copyEncrypt(key, bytes.NewReader(payload), enc)
+		assert.Nil(t, err)
+		assert.Equal(t, encryptedSize(int64(size)), int64(nw), "size %d", size)
+
+		out := new(bytes.Buffer)
+		_, err = copyDecrypt(key, enc, out)
+		assert.Nil(t, err, "size %d", size)
+		assert.True(t, bytes.Equal(payload, out.Bytes()), "size %d", size)
+	}
+}
+
+func TestCopyDecryptDetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	payload := make([]byte, 3*segmentSize+100)
+	io.ReadFull(rand.Reader, payload)
+
+	enc := new(bytes.Buffer)
+	_, err := copyEncrypt(key, bytes.NewReader(payload), enc)
+	assert.Nil(t, err)
+	sealed := enc.Bytes()
+
+	segment := func(i int) (int, int) {
+		from := streamHeaderSize + i*(segmentSize+segmentTagSize)
+		return from, from + segmentSize + segmentTagSize
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)/2] ^= 0x1
+
+	// 在分段边界截断，剩下的每一段都是完整的
+	_, secondEnd := segment(1)
+	truncatedAtBoundary := bytes.Clone(sealed[:secondEnd])
+	truncatedMidSegment := bytes.Clone(sealed[:secondEnd+100])
+
+	reordered := bytes.Clone(sealed)
+	firstFrom, firstTo := segment(0)
+	secondFrom, _ := segment(1)
+	copy(reordered[firstFrom:firstTo], sealed[secondFrom:secondEnd])
+	copy(reordered[secondFrom:secondEnd], sealed[firstFrom:firstTo])
+
+	cases := map[string][]byte{
+		"flipped bit":           flipped,
+		"truncated at boundary": truncatedAtBoundary,
+		"truncated mid segment": truncatedMidSegment,
+		"reordered segments":    reordered,
+		"header only":           bytes.Clone(sealed[:streamHeaderSize]),
+	}
+
+	for name, data := range cases {
+		_, err := copyDecrypt(key, bytes.NewReader(data), io.Discard)
+		assert.True(t, errors.Is(err, ErrStreamAuthentication), "%s: %v", name, err)
+	}
+
+	_, err = copyDecrypt(newEncryptionKey(), bytes.NewReader(sealed), io.Discard)
+	assert.True(t, errors.Is(err, ErrStreamAuthentication), "wrong key: %v", err)
+}
+
 func TestGId(t *testing.T) {
 	id := generateID()
 	fmt.Println(id)
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+const (
+	// defaultReconnectBackoff 是第一次重试连接前的默认等待时间
+	defaultReconnectBackoff = 500 * time.Millisecond
+	// defaultMaxReconnectBackoff 是重试连接前等待时间的默认上限
+	defaultMaxReconnectBackoff = 30 * time.Second
+)
+
+// backoff 计算带随机抖动的指数退避时间，每次失败后等待时间翻倍，直到达到上限
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// next 返回下一次重试前需要等待的时间，结果在 [d/2, d] 之间随机分布，避免多个节点同时重试
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if exp := b.min << b.attempt; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.attempt++
+
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// dialLoop 不断尝试连接 addr，失败后按指数退避重试，直到连接成功或者文件服务器停止
+func (s *FileServer) dialLoop(addr string) {
+	b := backoff{min: s.ReconnectBackoff, max: s.MaxReconnectBackoff}
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		default:
+		}
+
+		slog.Info("attempting connect with remote", "addr", addr)
+		err := s.Transport.Dial(addr)
+		if err == nil {
+			return
+		}
+
+		wait := b.next()
+		slog.Info("failed to dial", "addr", addr, "err", err, "retry in", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.quitCh:
+			timer.Stop()
+			return
+		}
+	}
+}
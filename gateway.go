@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Gateway 是文件服务器的 HTTP 网关，将 /objects/{key} 上的请求映射到 FileServer 的方法:
+//
+//	PUT    /objects/{key}  存储文件
+//	GET    /objects/{key}  获取文件，?versionId= 指定要获取的版本
+//	HEAD   /objects/{key}  获取文件大小
+//	DELETE /objects/{key}  从整个集群中删除文件
+//
+// 请求体和响应体都是流式传输的，不会整个读入内存
+// PUT 请求的 Content-Type 和 X-Meta-* 请求头作为文件的元数据保存，GET 和 HEAD 在响应头中返回
+// 文件的版本 ID 在 X-Version-Id 响应头中返回，并发写入的其他版本在 X-Version-Siblings 响应头中返回
+type Gateway struct {
+	server *FileServer
+	mux    *http.ServeMux
+}
+
+const (
+	// metaHeaderPrefix 是携带用户自定义元数据的请求头和响应头的前缀
+	metaHeaderPrefix = "X-Meta-"
+	// checksumHeader 是返回文件明文 SHA-256 的响应头
+	checksumHeader = "X-Checksum-Sha256"
+	// versionHeader 是返回文件版本 ID 的响应头
+	versionHeader = "X-Version-Id"
+	// siblingsHeader 是返回和当前版本并发写入的其他版本 ID 的响应头，多个版本 ID 用逗号分隔
+	siblingsHeader = "X-Version-Siblings"
+)
+
+// NewGateway 创建一个新的 HTTP 网关
+func NewGateway(s *FileServer) *Gateway {
+	g := &Gateway{
+		server: s,
+		mux:    http.NewServeMux(),
+	}
+
+	g.mux.HandleFunc("PUT /objects/{key...}", g.handlePut)
+	g.mux.HandleFunc("GET /objects/{key...}", g.handleGet)
+	g.mux.HandleFunc("HEAD /objects/{key...}", g.handleHead)
+	g.mux.HandleFunc("DELETE /objects/{key...}", g.handleDelete)
+
+	return g
+}
+
+// ServeHTTP 实现 http.Handler 接口
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+func (g *Gateway) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	versionID, err := g.server.StoreWithMetadata(key, r.Body, metadataFromHeader(r.Header))
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set(versionHeader, versionID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (g *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	fr, meta, err := g.server.Get(key, r.URL.Query().Get("versionId"))
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	if rc, ok := fr.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	writeMetadataHeader(w.Header(), meta)
+	if _, err := io.Copy(w, fr); err != nil {
+		slog.Error("HTTP gateway failed to stream file", "key", key, "error", err)
+	}
+}
+
+func (g *Gateway) handleHead(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	size, meta, err := g.server.Stat(key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	writeMetadataHeader(w.Header(), meta)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *Gateway) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	if err := g.server.Delete(key); err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError 将文件服务器返回的错误转换为对应的 HTTP 状态码
+// 存储返回的 *KeyNotFoundError 和文件系统的不存在错误都满足 errors.Is(err, os.ErrNotExist)
+func (g *Gateway) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrFileNotFound) || errors.Is(err, os.ErrNotExist) {
+		status = http.StatusNotFound
+	}
+
+	slog.Error("HTTP gateway request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// metadataFromHeader 从请求头中读取文件的元数据
+func metadataFromHeader(h http.Header) Metadata {
+	meta := Metadata{
+		ContentType: h.Get("Content-Type"),
+	}
+
+	for name, values := range h {
+		if !strings.HasPrefix(name, metaHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		if meta.User == nil {
+			meta.User = make(map[string]string)
+		}
+		meta.User[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = values[0]
+	}
+
+	return meta
+}
+
+// writeMetadataHeader 将文件的元数据写入响应头
+func writeMetadataHeader(h http.Header, meta Metadata) {
+	contentType := meta.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+
+	if len(meta.Checksum) > 0 {
+		h.Set(checksumHeader, meta.Checksum)
+	}
+	if len(meta.VersionID) > 0 {
+		h.Set(versionHeader, meta.VersionID)
+	}
+	if len(meta.Siblings) > 0 {
+		h.Set(siblingsHeader, strings.Join(meta.Siblings, ","))
+	}
+	if !meta.CreatedAt.IsZero() {
+		h.Set("Last-Modified", meta.CreatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	for k, v := range meta.User {
+		h.Set(metaHeaderPrefix+k, v)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func doRequest(t *testing.T, method string, url string, body io.Reader) (*http.Response, string) {
+	return doRequestWithHeader(t, method, url, body, nil)
+}
+
+func doRequestWithHeader(t *testing.T, method string, url string, body io.Reader, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, body)
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	return resp, string(b)
+}
+
+func TestGatewayLocal(t *testing.T) {
+	s := makeTestServer(t, "127.0.0.1:30910")
+	ts := httptest.NewServer(NewGateway(s))
+	defer ts.Close()
+
+	url := ts.URL + "/objects/photos/cat.png"
+	payload := "my big data file here!"
+
+	resp, _ := doRequest(t, http.MethodPut, url, strings.NewReader("first version"))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	first := resp.Header.Get(versionHeader)
+	assert.NotEmpty(t, first)
+
+	resp, _ = doRequest(t, http.MethodPut, url, strings.NewReader(payload))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, body := doRequest(t, http.MethodGet, url, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, payload, body)
+	assert.Greater(t, resp.Header.Get(versionHeader), first)
+
+	// 覆盖之后旧的版本依然可以获取
+	resp, body = doRequest(t, http.MethodGet, url+"?versionId="+first, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "first version", body)
+
+	resp, _ = doRequest(t, http.MethodHead, url, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(payload)), resp.ContentLength)
+
+	resp, _ = doRequest(t, http.MethodDelete, url, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodGet, url, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodHead, ts.URL+"/objects/missing", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGatewayFetchesFromPeers(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30911", withNodes("127.0.0.1:30912"))
+	b := makeTestServer(t, "127.0.0.1:30912")
+
+	startCluster(t, b, a)
+
+	ts := httptest.NewServer(NewGateway(a))
+	defer ts.Close()
+
+	key := "videos/dog.mp4"
+	url := ts.URL + "/objects/" + key
+	payload := strings.Repeat("some video bytes ", 10000)
+	checksum := sha256.Sum256([]byte(payload))
+
+	header := http.Header{}
+	header.Set("Content-Type", "video/mp4")
+	header.Set("X-Meta-Owner", "alice")
+
+	resp, _ := doRequestWithHeader(t, http.MethodPut, url, strings.NewReader(payload), header)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// 等副本写入 b 之后删除本地的副本，HEAD 和 GET 都只能从 b 获取
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Nil(t, a.store.Delete(a.ID, key))
+
+	// 元数据随文件一起复制到了 b
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		resp, body := doRequest(t, method, url, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "alice", resp.Header.Get("X-Meta-Owner"))
+		assert.Equal(t, hex.EncodeToString(checksum[:]), resp.Header.Get(checksumHeader))
+		assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+		if method == http.MethodHead {
+			assert.Equal(t, int64(len(payload)), resp.ContentLength)
+		} else {
+			assert.Equal(t, payload, body)
+		}
+	}
+
+	resp, _ = doRequest(t, http.MethodDelete, url, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.False(t, b.store.Has(a.ID, hashKey(key)))
+
+	resp, _ = doRequest(t, http.MethodGet, url, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGatewayMapsStoreNotFound(t *testing.T) {
+	g := NewGateway(makeTestServer(t, "127.0.0.1:30913"))
+
+	// 存储层的不存在错误和文件服务器的 ErrFileNotFound 一样返回 404
+	for _, err := range []error{
+		fmt.Errorf("read: %w", &KeyNotFoundError{ID: "id", Key: "key"}),
+		&fs.PathError{Op: "open", Path: "blob", Err: fs.ErrNotExist},
+		ErrFileNotFound,
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			w := httptest.NewRecorder()
+			g.writeError(w, httptest.NewRequest(method, "/objects/key", nil), err)
+			assert.Equal(t, http.StatusNotFound, w.Code, "%s: %v", method, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	g.writeError(w, httptest.NewRequest(http.MethodGet, "/objects/key", nil), errors.New("disk failure"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
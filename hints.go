@@ -0,0 +1,241 @@
+package main
+
+import (
+	"distributed-file-store/p2p"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	// defaultHintTTL 是暂存的副本默认保存的最长时间，过期的副本交给反熵同步修复
+	defaultHintTTL = 3 * time.Hour
+	// hintExpiryInterval 是两次清理过期的暂存副本之间的间隔
+	hintExpiryInterval = time.Minute
+)
+
+// MessageStoreHint 请求对端替离线的节点 Target 暂存一个副本，副本在 File.StreamID 指定的流中发送
+type MessageStoreHint struct {
+	Target string
+	File   MessageStoreFile
+}
+
+// offlineOwners 返回哈希环上负责存储 key、但当前没有连接的节点 ID
+func (s *FileServer) offlineOwners(key string) []string {
+	s.peerLock.Lock()
+	online := make(map[string]bool, len(s.nodeIDs))
+	for _, nodeID := range s.nodeIDs {
+		online[nodeID] = true
+	}
+	s.peerLock.Unlock()
+
+	var offline []string
+	for _, nodeID := range s.ring.Owners(hashKey(key), s.ReplicationFactor) {
+		if nodeID != s.ID && !online[nodeID] {
+			offline = append(offline, nodeID)
+		}
+	}
+
+	return offline
+}
+
+// hintHolder 返回一个不负责存储 key 的在线对端，用来暂存离线节点的副本，没有时返回 false
+func (s *FileServer) hintHolder(key string) (p2p.Peer, bool) {
+	owners := s.ring.Owners(hashKey(key), s.ReplicationFactor)
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for addr, nodeID := range s.nodeIDs {
+		if peer, ok := s.peers[addr]; ok && !slices.Contains(owners, nodeID) {
+			return peer, true
+		}
+	}
+
+	return nil, false
+}
+
+// handoff 为每个离线的副本节点暂存一份加密后的文件的版本 versionID，优先交给一个在线的其他节点，没有时保存在本地
+func (s *FileServer) handoff(key string, versionID string, targets []string) error {
+	holder, ok := s.hintHolder(key)
+
+	for _, target := range targets {
+		if !ok {
+			if err := s.storeHint(target, key, versionID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := s.sendEncrypted(key, versionID, []p2p.Peer{holder}, func(msg MessageStoreFile) any {
+			return MessageStoreHint{Target: target, File: msg}
+		})
+		if err != nil {
+			return err
+		}
+
+		slog.Info("handed off replica", "key", key, "node", target, "holder", holder.RemoteAddr())
+	}
+
+	return nil
+}
+
+// storeHint 将本节点的文件的版本 versionID 加密后暂存在本地，等节点 target 重新连接后再发送给它
+func (s *FileServer) storeHint(target string, key string, versionID string) error {
+	size, fr, meta, err := s.store.ReadVersion(s.ID, key, versionID)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		_, err := copyEncrypt(s.EncKey, fr, pw)
+		pw.CloseWithError(err)
+	}()
+
+	_, err = s.store.WriteHint(target, s.ID, hashKey(key), key, pr, encryptedSize(size), meta)
+	return err
+}
+
+// replayHints 将替节点 target 暂存的副本发送给它，对端确认写入或者已经过期的副本被删除
+func (s *FileServer) replayHints(peer p2p.Peer, target string) {
+	hints, err := s.store.Hints()
+	if err != nil {
+		slog.Error("failed to list hints", "error", err)
+		return
+	}
+
+	var replayed int
+	for _, h := range hints {
+		if h.Target != target {
+			continue
+		}
+
+		if !s.hintExpired(h) {
+			if err := s.replayHint(peer, h); err != nil {
+				slog.Error("failed to replay hint", "remote addr", peer.RemoteAddr(), "key", h.Name, "error", err)
+				return
+			}
+			replayed++
+		}
+
+		if err := s.store.RemoveHint(h); err != nil {
+			slog.Error("failed to remove hint", "key", h.Name, "error", err)
+		}
+	}
+
+	if replayed > 0 {
+		slog.Info("replayed hints", "remote addr", peer.RemoteAddr(), "count", replayed)
+	}
+}
+
+// replayHint 将一个暂存的副本原样发送给对端，并等待对端确认写入磁盘
+// 对端已经有更新的版本或者墓碑时拒绝写入，这个副本同样不再需要保留
+func (s *FileServer) replayHint(peer p2p.Peer, h StoredHint) error {
+	size, r, meta, err := s.store.ReadHint(h)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	req := s.addPendingRequest(1)
+	defer s.removePendingRequest(req)
+
+	msg := MessageStoreFile{
+		ID:        h.ID,
+		Key:       h.Key,
+		Size:      size,
+		Name:      h.Name,
+		Metadata:  meta,
+		RequestID: req.id,
+	}
+
+	if err := s.sendStream(peer, msg, r); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case v := <-req.respCh:
+		// 目标已经有更新的版本时暂存的副本不再需要
+		if ack := v.(MessageStoreAck); ack.Err != "" && !ack.Stale {
+			return errors.New(ack.Err)
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("[%s] timed out waiting for (%s) to acknowledge hint (%s)", s.Transport.Addr(), peer.RemoteAddr(), h.Name)
+	case <-s.quitCh:
+		return fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+	}
+}
+
+func (s *FileServer) hintExpired(h StoredHint) bool {
+	return time.Since(h.CreatedAt) > s.HintTTL
+}
+
+// hintLoop 每隔 hintExpiryInterval 清理一次过期的暂存副本，直到文件服务器停止
+func (s *FileServer) hintLoop() {
+	s.expireHints()
+
+	ticker := time.NewTicker(hintExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expireHints()
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// expireHints 删除所有过期的暂存副本
+func (s *FileServer) expireHints() {
+	hints, err := s.store.Hints()
+	if err != nil {
+		slog.Error("failed to list hints", "error", err)
+		return
+	}
+
+	for _, h := range hints {
+		if !s.hintExpired(h) {
+			continue
+		}
+
+		slog.Info("dropping expired hint", "node", h.Target, "key", h.Name, "created at", h.CreatedAt)
+		if err := s.store.RemoveHint(h); err != nil {
+			slog.Error("failed to remove hint", "key", h.Name, "error", err)
+		}
+	}
+}
+
+func (s *FileServer) handleMessageStoreHint(from string, msg MessageStoreHint) error {
+	// 对端把本节点当成了离线的节点，直接保存副本
+	if msg.Target == s.ID {
+		return s.handleMessageStoreFile(from, msg.File)
+	}
+
+	s.expectStream(from, msg.File.StreamID, func(peer p2p.Peer, st p2p.Stream) error {
+		n, err := s.store.WriteHint(msg.Target, msg.File.ID, msg.File.Key, msg.File.Name, st, msg.File.Size, msg.File.Metadata)
+		if err != nil {
+			st.Reset()
+			return err
+		}
+		st.Close()
+
+		fmt.Printf("[%s] stored %d bytes for offline node (%s)\n", s.Transport.Addr(), n, msg.Target)
+
+		return nil
+	})
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"distributed-file-store/p2p"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHintedHandoff(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30961", withNodes("127.0.0.1:30962"))
+	b := makeTestServer(t, "127.0.0.1:30962")
+	c := makeTestServer(t, "127.0.0.1:30963", withNodes("127.0.0.1:30962"))
+	for _, s := range []*FileServer{a, b, c} {
+		s.ReplicationFactor = 2
+	}
+
+	startCluster(t, b, a)
+
+	// c 已经在哈希环上，但是写入的时候不在线
+	a.ring.Add(c.ID)
+	b.ring.Add(c.ID)
+
+	// 找一个由 a 和 c 负责的 key，这样 b 就可以替 c 暂存副本
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("hinted_%d.txt", i)
+		owners := a.ring.Owners(hashKey(key), a.ReplicationFactor)
+		if slices.Contains(owners, c.ID) && !slices.Contains(owners, b.ID) {
+			break
+		}
+	}
+	hk := hashKey(key)
+
+	assert.Nil(t, a.Store(key, strings.NewReader("written while c was down")))
+	assert.Eventually(t, func() bool {
+		hints, err := b.store.Hints()
+		return err == nil && len(hints) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	hints, _ := b.store.Hints()
+	assert.Equal(t, StoredHint{Target: c.ID, ID: a.ID, Key: hk, Name: key, CreatedAt: hints[0].CreatedAt}, hints[0])
+	assert.False(t, b.store.Has(a.ID, hk))
+
+	// c 上线后 b 把暂存的副本发送给它
+	startServers(t, c)
+
+	assert.Eventually(t, func() bool {
+		return c.store.Has(a.ID, hk)
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		hints, err := b.store.Hints()
+		return err == nil && len(hints) == 0
+	}, 5*time.Second, 20*time.Millisecond)
+
+	want, _ := a.store.Metadata(a.ID, key)
+	got, err := c.store.Metadata(a.ID, hk)
+	assert.Nil(t, err)
+	assert.Equal(t, want.Checksum, got.Checksum)
+
+	_, r, err := c.store.Read(a.ID, hk)
+	assert.Nil(t, err)
+	var plain strings.Builder
+	_, err = copyDecrypt(a.EncKey, r, &plain)
+	r.(io.Closer).Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "written while c was down", plain.String())
+
+	// 超过 HintTTL 的副本会被清理掉
+	old := Metadata{CreatedAt: time.Now().Add(-2 * b.HintTTL)}
+	_, err = b.store.WriteHint(generateID(), a.ID, hk, key, strings.NewReader("x"), 1, old)
+	assert.Nil(t, err)
+
+	b.expireHints()
+	hints, err = b.store.Hints()
+	assert.Nil(t, err)
+	assert.Empty(t, hints)
+}
+
+func TestHintKeptUntilAcknowledged(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	b := makeTestServer(t, "b", onNetwork(network))
+	c := makeTestServer(t, "c", onNetwork(network), withNodes("b"))
+	b.RequestTimeout = 200 * time.Millisecond
+
+	startServers(t, b, c)
+
+	assert.Eventually(t, func() bool {
+		return b.ring.Len() == 2 && numPeers(b) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	peer := b.connectedPeers()[0]
+
+	owner, key := generateID(), hashKey("hinted")
+	_, err := b.store.WriteHint(c.ID, owner, key, "hinted", strings.NewReader("hinted data"), 11, Metadata{CreatedAt: time.Now()})
+	assert.Nil(t, err)
+
+	// c 没有确认写入时保留暂存的副本
+	network.SetDropRate(1)
+	b.replayHints(peer, c.ID)
+	hints, err := b.store.Hints()
+	assert.Nil(t, err)
+	assert.Len(t, hints, 1)
+	assert.False(t, c.store.Has(owner, key))
+
+	// c 确认之后删除
+	network.SetDropRate(0)
+	b.replayHints(peer, c.ID)
+	hints, err = b.store.Hints()
+	assert.Nil(t, err)
+	assert.Empty(t, hints)
+	assert.True(t, c.store.Has(owner, key))
+
+	// c 上已经有更新的墓碑时拒绝写入，暂存的副本同样不再需要
+	old := NewHLC(owner).Now()
+	deleted := hashKey("deleted")
+	assert.Nil(t, c.store.WriteTombstone(owner, deleted, c.clock.Now()))
+	_, err = b.store.WriteHint(c.ID, owner, deleted, "deleted", strings.NewReader("old data"), 8, Metadata{CreatedAt: old.Time(), VersionID: old.String()})
+	assert.Nil(t, err)
+
+	b.replayHints(peer, c.ID)
+	hints, err = b.store.Hints()
+	assert.Nil(t, err)
+	assert.Empty(t, hints)
+	assert.False(t, c.store.Has(owner, deleted))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionNodeLen 是版本 ID 中节点 ID 前缀的长度
+const versionNodeLen = 8
+
+// Timestamp 是混合逻辑时钟的一个时间戳，先比较物理时间 Wall，再比较逻辑计数 Logical，
+// 最后用生成它的节点 ID 打破平局，因此不同节点生成的时间戳之间也有确定的先后顺序
+type Timestamp struct {
+	// Wall 是 Unix 纳秒时间
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+// String 返回时间戳对应的版本 ID，版本 ID 按字典序排列的顺序和时间戳的先后顺序一致
+func (t Timestamp) String() string {
+	node := t.Node
+	if len(node) > versionNodeLen {
+		node = node[:versionNodeLen]
+	}
+
+	return fmt.Sprintf("%016x-%08x-%s", t.Wall, t.Logical, node)
+}
+
+// Time 返回时间戳的物理时间
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall).UTC()
+}
+
+// Compare 比较两个时间戳，t 在 o 之前时返回 -1，之后时返回 1，相同时返回 0
+func (t Timestamp) Compare(o Timestamp) int {
+	if c := cmp.Compare(t.Wall, o.Wall); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(t.Logical, o.Logical); c != 0 {
+		return c
+	}
+
+	return strings.Compare(t.Node, o.Node)
+}
+
+// ParseVersion 解析 Timestamp.String 返回的版本 ID
+func ParseVersion(id string) (Timestamp, error) {
+	parts := strings.SplitN(id, "-", 3)
+	if len(parts) != 3 {
+		return Timestamp{}, fmt.Errorf("invalid version id (%s)", id)
+	}
+
+	wall, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("invalid version id (%s): %w", id, err)
+	}
+
+	logical, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("invalid version id (%s): %w", id, err)
+	}
+
+	return Timestamp{Wall: wall, Logical: uint32(logical), Node: parts[2]}, nil
+}
+
+// HLC 是一个混合逻辑时钟，生成的时间戳接近物理时间，并且总是在本节点之前生成
+// 和通过 Update 观察到的所有时间戳之后，这样即使节点之间的时钟有偏差，副本也能对版本的先后达成一致
+type HLC struct {
+	mu   sync.Mutex
+	node string
+	last Timestamp
+	// now 返回当前的物理时间，测试时可以替换
+	now func() time.Time
+}
+
+// NewHLC 创建一个新的混合逻辑时钟，node 是本节点的 ID
+func NewHLC(node string) *HLC {
+	return &HLC{node: node, now: time.Now}
+}
+
+// Now 返回一个新的时间戳
+func (c *HLC) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wall := c.now().UnixNano(); wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	c.last.Node = c.node
+
+	return c.last
+}
+
+// Update 观察一个其他节点生成的时间戳，之后生成的时间戳都在它之后
+func (c *HLC) Update(ts Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ts.Wall > c.last.Wall || (ts.Wall == c.last.Wall && ts.Logical > c.last.Logical) {
+		c.last.Wall, c.last.Logical = ts.Wall, ts.Logical
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHLC(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := NewHLC("node-a-0123456789")
+	clock.now = func() time.Time { return now }
+
+	// 物理时间不变时逻辑计数递增
+	t1, t2 := clock.Now(), clock.Now()
+	assert.Equal(t, now.UnixNano(), t1.Wall)
+	assert.Equal(t, uint32(1), t2.Logical)
+	assert.Equal(t, -1, t1.Compare(t2))
+	assert.Less(t, t1.String(), t2.String())
+
+	// 观察到一个时钟更快的节点的时间戳之后，生成的时间戳都排在它之后
+	remote := Timestamp{Wall: now.Add(time.Minute).UnixNano(), Logical: 7, Node: "node-b"}
+	clock.Update(remote)
+	t3 := clock.Now()
+	assert.Equal(t, 1, t3.Compare(remote))
+	assert.Less(t, remote.String(), t3.String())
+
+	// 本地的物理时间追上之后，逻辑计数清零
+	now = now.Add(time.Hour)
+	t4 := clock.Now()
+	assert.Equal(t, now.UnixNano(), t4.Wall)
+	assert.Equal(t, uint32(0), t4.Logical)
+	assert.Equal(t, now.UTC(), t4.Time())
+
+	parsed, err := ParseVersion(t4.String())
+	assert.Nil(t, err)
+	assert.Equal(t, Timestamp{Wall: t4.Wall, Logical: t4.Logical, Node: "node-a-0"}, parsed)
+
+	_, err = ParseVersion("not-a-version")
+	assert.NotNil(t, err)
+}
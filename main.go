@@ -9,15 +9,23 @@ import (
 	"time"
 )
 
-func makeServer(listenAddr string, nodes ...string) *FileServer {
+func makeServer(listenAddr string, allowlist *p2p.Allowlist, nodes ...string) *FileServer {
+	identity, err := p2p.NewIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+	allowlist.Add(identity.PublicKey())
+
 	tcpTransportOpts := p2p.TCPTransportOpts{
 		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
+		HandshakeFunc: p2p.AuthHandshakeFunc(identity, allowlist),
 		Decoder:       p2p.DefaultDecoder{},
+		TLSIdentity:   identity,
 	}
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
 
 	fileServerOpts := FileServerOpts{
+		Identity:          identity,
 		EncKey:            newEncryptionKey(),
 		StorageRoot:       string(listenAddr[1:]) + "_network",
 		PathTransformFunc: CASPathTransformFunc,
@@ -25,17 +33,23 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 		BootstrapNodes:    nodes,
 	}
 
-	s := NewFileServer(fileServerOpts)
+	s, err := NewFileServer(fileServerOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 }
 
 func main() {
-	s1 := makeServer(":30000", "")
-	s2 := makeServer(":7000", "")
-	s3 := makeServer(":5000", ":30000", ":7000")
+	// 只有互相信任的节点之间才能建立连接
+	allowlist := p2p.NewAllowlist()
+	s1 := makeServer(":30000", allowlist, "")
+	s2 := makeServer(":7000", allowlist, "")
+	s3 := makeServer(":5000", allowlist, ":30000", ":7000")
 
 	go func() { log.Fatal(s1.Start()) }()
 	time.Sleep(500 * time.Millisecond)
@@ -49,13 +63,16 @@ func main() {
 	for i := 0; i < 20; i++ {
 		key := fmt.Sprintf("picture_%d.png", i)
 		data := bytes.NewReader([]byte("my big data file here!"))
-		s3.Store(key, data)
+		if err := s3.Store(key, data); err != nil {
+			log.Fatal(err)
+		}
 
+		// 只删除本地的副本，这样 Get 就需要从网络上的其他节点获取文件
 		if err := s3.store.Delete(s3.ID, key); err != nil {
 			log.Fatal(err)
 		}
 
-		r, err := s3.Get(key)
+		r, _, err := s3.Get(key)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -66,6 +83,15 @@ func main() {
 		}
 
 		fmt.Println(string(b))
+
+		// 从整个集群中删除文件，之后再也无法获取到它
+		if err := s3.Delete(key); err != nil {
+			log.Fatal(err)
+		}
+
+		if _, _, err := s3.Get(key); err == nil {
+			log.Fatalf("file (%s) still available after cluster delete", key)
+		}
 	}
 
 }
@@ -1,10 +1,19 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// DefaultMaxFrameSize 是 DefaultDecoder 默认允许的最大负载长度
+const DefaultMaxFrameSize = 4 << 20
+
+// ErrFrameTooLarge 表示收到的帧超过了允许的最大长度
+var ErrFrameTooLarge = errors.New("p2p: frame too large")
+
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
@@ -15,30 +24,112 @@ func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 	return gob.NewDecoder(r).Decode(msg)
 }
 
-type DefaultDecoder struct{}
+// DefaultDecoder 按帧读取数据，帧的格式为: 类型字节 + 帧头 + 负载，帧头中的整数都是 uvarint
+//
+//	IncomingMessage: 长度 + 负载
+//	StreamOpen、StreamClose、StreamReset: 流 ID
+//	StreamWindow: 流 ID + 窗口增量
+//	StreamData: 流 ID + 长度 + 负载
+type DefaultDecoder struct {
+	// MaxFrameSize 是允许的最大负载长度，为 0 时使用 DefaultMaxFrameSize
+	MaxFrameSize int
+}
 
-// Decode 从 r 中读取数据并解码到 msg 中
+// Decode 从 r 中读取一帧数据并解码到 msg 中
 func (d DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+	br := byteReader{r}
+
+	frameType, err := br.ReadByte()
+	if err != nil {
+		return err
 	}
+	msg.Type = frameType
 
-	// 在流的情况下，不会解码通过网络发送的内容
-	// 只是将 Stream 设置为 true，这样就可以在逻辑中处理它
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
+	switch frameType {
+	case IncomingMessage:
+		return d.readPayload(br, msg)
+	case StreamOpen, StreamClose, StreamReset:
+		msg.StreamID, err = binary.ReadUvarint(br)
+		return err
+	case StreamWindow:
+		if msg.StreamID, err = binary.ReadUvarint(br); err != nil {
+			return err
+		}
+		msg.Window, err = binary.ReadUvarint(br)
+		return err
+	case StreamData:
+		if msg.StreamID, err = binary.ReadUvarint(br); err != nil {
+			return err
+		}
+		return d.readPayload(br, msg)
+	default:
+		return fmt.Errorf("p2p: unknown frame type 0x%x", frameType)
 	}
+}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
+// readPayload 读取长度和紧跟在后面的负载
+func (d DefaultDecoder) readPayload(br byteReader, msg *RPC) error {
+	size, err := binary.ReadUvarint(br)
 	if err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	if size > uint64(d.maxFrameSize()) {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrFrameTooLarge, size, d.maxFrameSize())
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(br.Reader, buf); err != nil {
+		return err
+	}
+
+	msg.Payload = buf
 
 	return nil
 }
+
+func (d DefaultDecoder) maxFrameSize() int {
+	if d.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return d.MaxFrameSize
+}
+
+// EncodeMessage 将负载编码为 DefaultDecoder 能够解码的消息帧
+func EncodeMessage(payload []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(payload))
+	buf[0] = IncomingMessage
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(payload)))
+	n += copy(buf[n:], payload)
+	return buf[:n]
+}
+
+// encodeStreamFrame 编码一个流帧，StreamWindow 帧的 n 是窗口增量，StreamData 帧的负载是 payload
+func encodeStreamFrame(frameType byte, id uint64, n uint64, payload []byte) []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64+len(payload))
+	buf[0] = frameType
+	off := 1 + binary.PutUvarint(buf[1:], id)
+
+	switch frameType {
+	case StreamWindow:
+		off += binary.PutUvarint(buf[off:], n)
+	case StreamData:
+		off += binary.PutUvarint(buf[off:], uint64(len(payload)))
+		off += copy(buf[off:], payload)
+	}
+
+	return buf[:off]
+}
+
+// byteReader 每次只从底层读取一个字节，这样就不会多读走下一帧的数据
+type byteReader struct {
+	io.Reader
+}
+
+func (b byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(b.Reader, buf[:]); err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
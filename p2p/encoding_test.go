@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoderFrames(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 4096)
+
+	buf := new(bytes.Buffer)
+	buf.Write(EncodeMessage([]byte("first")))
+	buf.Write(EncodeMessage(large))
+	buf.Write(encodeStreamFrame(StreamData, 7, 0, []byte("stream bytes")))
+	buf.Write(encodeStreamFrame(StreamWindow, 7, 4096, nil))
+	buf.Write(encodeStreamFrame(StreamClose, 7, 0, nil))
+	buf.WriteString("next")
+
+	dec := DefaultDecoder{}
+
+	var rpc RPC
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, "first", string(rpc.Payload))
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, large, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, byte(StreamData), rpc.Type)
+	assert.Equal(t, uint64(7), rpc.StreamID)
+	assert.Equal(t, "stream bytes", string(rpc.Payload))
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, byte(StreamWindow), rpc.Type)
+	assert.Equal(t, uint64(4096), rpc.Window)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, byte(StreamClose), rpc.Type)
+	assert.Equal(t, uint64(7), rpc.StreamID)
+	// 解码器不会多读走下一帧的数据
+	assert.Equal(t, "next", buf.String())
+}
+
+func TestDefaultDecoderMaxFrameSize(t *testing.T) {
+	buf := bytes.NewReader(EncodeMessage(make([]byte, 100)))
+
+	var rpc RPC
+	err := DefaultDecoder{MaxFrameSize: 64}.Decode(buf, &rpc)
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+}
+
+func TestNegotiateProtocolRejectsOldNode(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// 旧节点直接发送消息，不会发送协议头
+	go func() {
+		b.Write([]byte{IncomingMessage, 'h', 'e', 'l', 'l', 'o'})
+		b.Read(make([]byte, 4))
+	}()
+
+	err := negotiateProtocol(a, defaultHandshakeTimeout)
+	assert.True(t, errors.Is(err, ErrIncompatibleProtocol))
+}
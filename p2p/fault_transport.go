@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrFaultInjected 表示写入被 FaultTransport 注入的故障中断
+var ErrFaultInjected = errors.New("p2p: injected fault")
+
+// FaultConfig 描述 FaultTransport 注入的故障，概率都是针对每一次写入的
+type FaultConfig struct {
+	// Seed 决定注入哪些故障，相同的 Seed 和相同顺序的写入得到相同的故障
+	Seed int64
+	// Latency 和 Jitter 是每次写入之前等待的时间，等待 Latency 加上 [0, Jitter) 之间的随机时间
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bandwidth 是每秒最多写入的字节数，所有的对端共享，为 0 时不限制
+	Bandwidth int
+	// ResetRate 是写入之前断开连接的概率
+	ResetRate float64
+	// PartialWriteRate 是只写入一部分数据然后断开连接的概率
+	PartialWriteRate float64
+	// CorruptRate 是写入的数据中有一个比特被翻转的概率
+	CorruptRate float64
+}
+
+// FaultTransport 包装另一个 Transport，在它的连接上注入延迟、带宽限制、连接重置、部分写入和数据损坏，
+// 用于在测试中检查上层在恶劣的网络下是否依然正确。故障作用于连接上本端写入的每一个字节，
+// 包括协议协商、握手、消息和流的所有帧，两端都包装时双向的数据都会受到影响。
+// 需要在被包装的 transport 开始监听和发起连接之前创建 FaultTransport
+type FaultTransport struct {
+	Transport
+
+	mu     sync.Mutex
+	config FaultConfig
+	rand   *rand.Rand
+	// next 是带宽限制下下一次写入可以开始的时间
+	next time.Time
+}
+
+// NewFaultTransport 创建一个包装 inner 的 FaultTransport，之后 inner 建立的连接都会被注入故障
+func NewFaultTransport(inner ConnWrapper, config FaultConfig) *FaultTransport {
+	t := &FaultTransport{
+		Transport: inner,
+		config:    config,
+		rand:      rand.New(rand.NewSource(config.Seed)),
+	}
+	inner.WrapConns(t.wrapConn)
+
+	return t
+}
+
+// SetConfig 替换注入的故障，config.Seed 被忽略，随机数继续沿用创建时的 Seed
+func (t *FaultTransport) SetConfig(config FaultConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.config = config
+}
+
+// wrapConn 把连接包装成注入故障的连接
+// SetHandshakeTimeout 实现 HandshakeConfigurer 接口，修改被包装的 transport 的握手超时时间
+func (t *FaultTransport) SetHandshakeTimeout(d time.Duration) {
+	if inner, ok := t.Transport.(HandshakeConfigurer); ok {
+		inner.SetHandshakeTimeout(d)
+	}
+}
+
+func (t *FaultTransport) wrapConn(conn net.Conn) net.Conn {
+	return &faultConn{Conn: conn, t: t}
+}
+
+// fault 是对一次写入注入的故障
+type fault struct {
+	wait  time.Duration
+	reset bool
+	// cut 大于等于 0 时只写入前 cut 个字节，然后断开连接
+	cut int
+	// flip 大于等于 0 时翻转第 flip/8 个字节中的第 flip%8 个比特
+	flip int
+}
+
+// plan 为一次 n 字节的写入决定注入的故障
+func (t *FaultTransport) plan(n int) fault {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.config
+	f := fault{wait: c.Latency, cut: -1, flip: -1}
+	if c.Jitter > 0 {
+		f.wait += time.Duration(t.rand.Int63n(int64(c.Jitter)))
+	}
+
+	if c.Bandwidth > 0 {
+		now := time.Now()
+		if t.next.Before(now) {
+			t.next = now
+		}
+		t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(c.Bandwidth))
+		f.wait += t.next.Sub(now)
+	}
+
+	switch {
+	case t.rand.Float64() < c.ResetRate:
+		f.reset = true
+	case n > 0 && t.rand.Float64() < c.PartialWriteRate:
+		f.cut = t.rand.Intn(n)
+	case n > 0 && t.rand.Float64() < c.CorruptRate:
+		f.flip = t.rand.Intn(n * 8)
+	}
+
+	return f
+}
+
+// apply 等待之后对 b 注入故障 f，返回需要写入的数据，ok 为 false 时写入之后需要断开连接
+func (f fault) apply(b []byte) (out []byte, ok bool) {
+	time.Sleep(f.wait)
+
+	switch {
+	case f.reset:
+		return nil, false
+	case f.cut >= 0:
+		return b[:f.cut], false
+	case f.flip >= 0:
+		out = append([]byte(nil), b...)
+		out[f.flip/8] ^= 1 << (f.flip % 8)
+		return out, true
+	}
+
+	return b, true
+}
+
+// faultConn 在连接的写入上注入故障，重置和部分写入之后断开连接，对端读到的是一个不完整的帧
+type faultConn struct {
+	net.Conn
+	t *FaultTransport
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	out, ok := c.t.plan(len(b)).apply(b)
+
+	n, err := c.Conn.Write(out)
+	if err != nil {
+		return n, err
+	}
+
+	if !ok {
+		c.Conn.Close()
+		return n, ErrFaultInjected
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/bits"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultPlan(t *testing.T) {
+	data := bytes.Repeat([]byte("fault"), 100)
+
+	newFaults := func(config FaultConfig) *FaultTransport {
+		return NewFaultTransport(NewMemTransport(MemTransportOpts{}), config)
+	}
+
+	// 相同的 Seed 注入相同的故障
+	config := FaultConfig{Seed: 42, Jitter: time.Millisecond, PartialWriteRate: 0.3, CorruptRate: 0.3}
+	a, b := newFaults(config), newFaults(config)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, a.plan(len(data)), b.plan(len(data)))
+	}
+
+	corrupt := newFaults(FaultConfig{CorruptRate: 1})
+	out, ok := corrupt.plan(len(data)).apply(data)
+	assert.True(t, ok)
+	assert.Equal(t, bytes.Repeat([]byte("fault"), 100), data)
+	var flipped int
+	for i := range data {
+		flipped += bits.OnesCount8(data[i] ^ out[i])
+	}
+	assert.Equal(t, 1, flipped)
+
+	partial := newFaults(FaultConfig{PartialWriteRate: 1})
+	out, ok = partial.plan(len(data)).apply(data)
+	assert.False(t, ok)
+	assert.Less(t, len(out), len(data))
+	assert.Equal(t, data[:len(out)], out)
+
+	reset := newFaults(FaultConfig{ResetRate: 1})
+	out, ok = reset.plan(len(data)).apply(data)
+	assert.False(t, ok)
+	assert.Empty(t, out)
+
+	// 带宽限制下写入依次排队
+	slow := newFaults(FaultConfig{Bandwidth: 1000})
+	var wait time.Duration
+	for i := 0; i < 3; i++ {
+		wait = slow.plan(100).wait
+	}
+	assert.InDelta(t, 300*time.Millisecond, wait, float64(50*time.Millisecond))
+}
+
+func TestFaultConn(t *testing.T) {
+	t.Parallel()
+
+	network := NewMemNetwork(1)
+	accepted := make(chan Peer, 1)
+	disconnected := make(chan Peer, 1)
+	b := NewMemTransport(MemTransportOpts{
+		ListenAddr: "b",
+		Network:    network,
+		OnPeer: func(p Peer) error {
+			accepted <- p
+			return nil
+		},
+		OnPeerDisconnect: func(p Peer) { disconnected <- p },
+	})
+	assert.Nil(t, b.ListenAndAccept())
+
+	// 在 a 到 b 的连接上注入故障，协议协商和握手也经过注入故障的连接
+	connected := make(chan Peer, 1)
+	a := NewMemTransport(MemTransportOpts{
+		ListenAddr: "a",
+		Network:    network,
+		OnPeer: func(p Peer) error {
+			connected <- p
+			return nil
+		},
+	})
+	ft := NewFaultTransport(a, FaultConfig{})
+	assert.Nil(t, ft.Dial("b"))
+	toB, toA := <-connected, <-accepted
+
+	// 没有故障时连接和原来的一样工作
+	assert.Nil(t, toB.Send(EncodeMessage([]byte("intact"))))
+	assert.Equal(t, "intact", string((<-b.Consume()).Payload))
+
+	st, err := toB.OpenStream()
+	assert.Nil(t, err)
+	rst, err := toA.AcceptStream()
+	assert.Nil(t, err)
+	_, err = st.Write([]byte("streamed"))
+	assert.Nil(t, err)
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(rst, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "streamed", string(buf))
+
+	// 流的数据帧只写入了一部分之后连接被断开，对端读不到被截断的帧中的数据
+	ft.SetConfig(FaultConfig{PartialWriteRate: 1})
+	_, err = st.Write(bytes.Repeat([]byte("x"), 1000))
+	assert.True(t, errors.Is(err, ErrFaultInjected))
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("partial write did not reset the connection")
+	}
+	data, err := io.ReadAll(rst)
+	assert.NotNil(t, err)
+	assert.Empty(t, data)
+
+	// 连接断开之后消息也无法再发送
+	err = toB.Send(EncodeMessage([]byte("after reset")))
+	assert.NotNil(t, err)
+	select {
+	case rpc := <-b.Consume():
+		t.Fatalf("received message of %d bytes after the connection was reset", len(rpc.Payload))
+	default:
+	}
+}
+
+func TestFaultTransportWrapsConns(t *testing.T) {
+	t.Parallel()
+
+	network := NewMemNetwork(1)
+	b := NewMemTransport(MemTransportOpts{ListenAddr: "b", Network: network})
+	assert.Nil(t, b.ListenAndAccept())
+
+	// 只要创建了 FaultTransport，被包装的 transport 建立的连接就会被注入故障
+	a := NewMemTransport(MemTransportOpts{ListenAddr: "a", Network: network})
+	ft := NewFaultTransport(a, FaultConfig{ResetRate: 1})
+	assert.NotNil(t, a.Dial("b"))
+	assert.NotNil(t, ft.Dial("b"))
+
+	ft.SetConfig(FaultConfig{})
+	assert.Nil(t, ft.Dial("b"))
+}
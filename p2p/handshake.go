@@ -1,8 +1,135 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ProtocolVersion 是当前线路格式的版本，握手时双方必须一致
+const ProtocolVersion = 2
+
+// protocolMagic 是每个连接上最先发送的字节，用来识别不支持分帧格式的旧节点
+var protocolMagic = []byte("DFS")
+
+// ErrIncompatibleProtocol 表示对端使用了不兼容的线路格式
+var ErrIncompatibleProtocol = errors.New("p2p: incompatible protocol")
+
 // HandshakeFunc 是一个握手函数
 type HandshakeFunc func(peer Peer) error
 
 func NOPHandshakeFunc(peer Peer) error {
 	return nil
 }
+
+// authContext 是握手签名的前缀，避免签名被用在其他场合
+var authContext = []byte("DFS-AUTH-v1")
+
+// authNonceSize 是握手时每一方发送的随机挑战的长度
+const authNonceSize = 32
+
+var (
+	// ErrUntrustedPeer 表示对端的公钥不在 Allowlist 中
+	ErrUntrustedPeer = errors.New("p2p: untrusted peer")
+	// ErrAuthenticationFailed 表示对端没能证明它持有声称的公钥对应的私钥
+	ErrAuthenticationFailed = errors.New("p2p: peer authentication failed")
+)
+
+// AuthHandshakeFunc 返回一个双向认证的握手函数，双方同时进行下面的步骤:
+//
+//  1. 发送自己的公钥和一个随机挑战: publicKey(32) | nonce(32)
+//  2. 检查对端的公钥在 allowlist 中
+//  3. 对 authContext | 对端的挑战 | 自己的公钥 | 对端的公钥 签名并发送: signature(64)
+//  4. 用对端的公钥验证它对自己的挑战的签名
+//
+// 签名中包含了双方的公钥，不能被转发给其他节点使用。allowlist 为 nil 时接受任何证明了持有私钥的对端。
+// 握手成功后对端的公钥可以通过 Peer.PublicKey 获得，等待对端的超时时间由 transport 的 HandshakeTimeout 决定
+func AuthHandshakeFunc(identity *Identity, allowlist *Allowlist) HandshakeFunc {
+	return func(peer Peer) error {
+		nonce := make([]byte, authNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+
+		local := identity.PublicKey()
+		hello, err := exchange(peer, append(append([]byte{}, local...), nonce...))
+		if err != nil {
+			return fmt.Errorf("%w: exchanging keys: %v", ErrAuthenticationFailed, err)
+		}
+
+		remote := ed25519.PublicKey(hello[:ed25519.PublicKeySize])
+		remoteNonce := hello[ed25519.PublicKeySize:]
+		if allowlist != nil && !allowlist.Contains(remote) {
+			return fmt.Errorf("%w: %s", ErrUntrustedPeer, KeyID(remote))
+		}
+
+		sig, err := exchange(peer, identity.Sign(authTranscript(remoteNonce, local, remote)))
+		if err != nil {
+			return fmt.Errorf("%w: exchanging signatures: %v", ErrAuthenticationFailed, err)
+		}
+
+		if !ed25519.Verify(remote, authTranscript(nonce, remote, local), sig) {
+			return fmt.Errorf("%w: invalid signature from %s", ErrAuthenticationFailed, KeyID(remote))
+		}
+
+		if p, ok := peer.(interface{ setPublicKey(ed25519.PublicKey) }); ok {
+			p.setPublicKey(remote)
+		}
+
+		return nil
+	}
+}
+
+// authTranscript 返回签名者 signer 对挑战 nonce 签名的内容
+func authTranscript(nonce []byte, signer, verifier ed25519.PublicKey) []byte {
+	msg := append([]byte{}, authContext...)
+	msg = append(msg, nonce...)
+	msg = append(msg, signer...)
+	return append(msg, verifier...)
+}
+
+// exchange 向对端发送 local，同时读取对端发来的同样长度的数据
+// 写入放在单独的 goroutine 中，避免双方在无缓冲的连接上互相阻塞
+func exchange(conn net.Conn, local []byte) ([]byte, error) {
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(local)
+		writeErr <- err
+	}()
+
+	remote := make([]byte, len(local))
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, err
+	}
+
+	return remote, <-writeErr
+}
+
+// negotiateProtocol 与对端交换协议头，确认双方使用相同版本的帧格式
+// 旧节点不会发送协议头，会因为超时或者内容不匹配被识别出来
+// 协商失败时调用方需要关闭连接
+func negotiateProtocol(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// 双方同时发送协议头
+	remote, err := exchange(conn, append(append([]byte{}, protocolMagic...), ProtocolVersion))
+	if err != nil {
+		return fmt.Errorf("%w: reading protocol header: %v", ErrIncompatibleProtocol, err)
+	}
+
+	if !bytes.Equal(remote[:len(protocolMagic)], protocolMagic) {
+		return fmt.Errorf("%w: peer did not send a protocol header", ErrIncompatibleProtocol)
+	}
+
+	if version := remote[len(protocolMagic)]; version != ProtocolVersion {
+		return fmt.Errorf("%w: peer speaks version %d, we speak version %d", ErrIncompatibleProtocol, version, ProtocolVersion)
+	}
+
+	return nil
+}
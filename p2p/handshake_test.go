@@ -0,0 +1,79 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handshakePair 在一对相连的对端上同时运行两个握手函数
+func handshakePair(a, b HandshakeFunc) (*TCPPeer, *TCPPeer, error, error) {
+	c1, c2 := net.Pipe()
+	p1, p2 := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+
+	errCh := make(chan error, 1)
+	go func() {
+		err := b(p2)
+		if err != nil {
+			c2.Close()
+		}
+		errCh <- err
+	}()
+
+	err := a(p1)
+	if err != nil {
+		c1.Close()
+	}
+
+	return p1, p2, err, <-errCh
+}
+
+func TestAuthHandshake(t *testing.T) {
+	alice, err := NewIdentity()
+	assert.Nil(t, err)
+	bob, err := NewIdentity()
+	assert.Nil(t, err)
+	mallory, err := NewIdentity()
+	assert.Nil(t, err)
+
+	allowlist := NewAllowlist(alice.PublicKey(), bob.PublicKey())
+
+	// 双方都在 allowlist 中，握手之后可以得到对端的公钥
+	p1, p2, err1, err2 := handshakePair(AuthHandshakeFunc(alice, allowlist), AuthHandshakeFunc(bob, allowlist))
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, bob.ID(), KeyID(p1.PublicKey()))
+	assert.Equal(t, alice.ID(), KeyID(p2.PublicKey()))
+
+	// 不在 allowlist 中的对端被拒绝
+	_, _, err1, err2 = handshakePair(AuthHandshakeFunc(alice, allowlist), AuthHandshakeFunc(mallory, allowlist))
+	assert.True(t, errors.Is(err1, ErrUntrustedPeer))
+	assert.NotNil(t, err2)
+
+	// 声称持有 bob 的公钥但是没有 bob 的私钥
+	impostor := func(peer Peer) error {
+		if _, err := exchange(peer, append(bob.PublicKey(), make([]byte, authNonceSize)...)); err != nil {
+			return err
+		}
+		_, err := exchange(peer, mallory.Sign([]byte("forged")))
+		return err
+	}
+	_, _, err1, _ = handshakePair(AuthHandshakeFunc(alice, allowlist), impostor)
+	assert.True(t, errors.Is(err1, ErrAuthenticationFailed))
+}
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node", "identity")
+
+	id, err := LoadIdentity(path)
+	assert.Nil(t, err)
+
+	// 再次读取得到同一个身份
+	again, err := LoadIdentity(path)
+	assert.Nil(t, err)
+	assert.Equal(t, id.ID(), again.ID())
+	assert.Len(t, id.ID(), 64)
+}
@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Identity 是一个节点的 Ed25519 身份，节点 ID 由它的公钥决定
+type Identity struct {
+	privateKey ed25519.PrivateKey
+}
+
+// NewIdentity 生成一个新的随机身份
+func NewIdentity() (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{privateKey: priv}, nil
+}
+
+// LoadIdentity 从文件中读取身份，文件中保存的是十六进制编码的私钥种子
+// 文件不存在时生成一个新的身份并写入文件，这样节点重启之后 ID 保持不变
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+
+		seed := hex.EncodeToString(id.privateKey.Seed())
+		if err := os.WriteFile(path, []byte(seed+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("p2p: invalid identity file (%s)", path)
+	}
+
+	return &Identity{privateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// PublicKey 返回身份的公钥
+func (i *Identity) PublicKey() ed25519.PublicKey {
+	return i.privateKey.Public().(ed25519.PublicKey)
+}
+
+// ID 返回由公钥决定的节点 ID
+func (i *Identity) ID() string {
+	return KeyID(i.PublicKey())
+}
+
+// Sign 用身份的私钥对 msg 签名
+func (i *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(i.privateKey, msg)
+}
+
+// KeyID 返回公钥对应的节点 ID，即公钥的十六进制编码
+func KeyID(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+// Allowlist 是可信任的公钥集合，握手时只接受集合中的公钥，可以并发地使用
+type Allowlist struct {
+	mu   sync.RWMutex
+	keys map[string]bool
+}
+
+// NewAllowlist 创建一个包含 keys 的 Allowlist
+func NewAllowlist(keys ...ed25519.PublicKey) *Allowlist {
+	a := &Allowlist{keys: make(map[string]bool)}
+	for _, key := range keys {
+		a.Add(key)
+	}
+
+	return a
+}
+
+// Add 信任一个公钥
+func (a *Allowlist) Add(key ed25519.PublicKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.keys[KeyID(key)] = true
+}
+
+// Remove 不再信任一个公钥，已经建立的连接不受影响
+func (a *Allowlist) Remove(key ed25519.PublicKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.keys, KeyID(key))
+}
+
+// Contains 判断一个公钥是否可信任
+func (a *Allowlist) Contains(key ed25519.PublicKey) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.keys[KeyID(key)]
+}
@@ -0,0 +1,369 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrAddrInUse 表示内存网络上已经有 transport 监听这个地址
+	ErrAddrInUse = errors.New("p2p: address already in use")
+	// ErrUnreachable 表示内存网络上的地址没有 transport 监听，或者和本端之间有分区
+	ErrUnreachable = errors.New("p2p: address unreachable")
+)
+
+// MemNetwork 是一个内存中的网络，同一个网络上的 MemTransport 通过 net.Pipe 互相连接，不占用端口。
+// 测试可以在网络上加入延迟、随机丢弃消息和制造分区，消息的丢弃由创建网络时的 seed 决定
+type MemNetwork struct {
+	mu         sync.Mutex
+	transports map[string]*MemTransport
+	// conns 保存所有还没有关闭的连接，制造分区时断开跨越分区的连接
+	conns map[*memConn]struct{}
+	// partitions 保存互相不可达的地址对
+	partitions map[[2]string]bool
+	latency    time.Duration
+	dropRate   float64
+	rand       *rand.Rand
+	// nextConn 用来为接受连接的一端生成不同的远端地址，就像 TCP 的临时端口
+	nextConn int
+}
+
+// NewMemNetwork 创建一个空的内存网络
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		transports: make(map[string]*MemTransport),
+		conns:      make(map[*memConn]struct{}),
+		partitions: make(map[[2]string]bool),
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetLatency 设置网络上的延迟，写入的数据在延迟之后才能被对端读到
+func (n *MemNetwork) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.latency = d
+}
+
+// SetDropRate 设置消息被丢弃的概率，只丢弃交给上层的消息，流和握手的数据不受影响
+func (n *MemNetwork) SetDropRate(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.dropRate = rate
+}
+
+// Partition 断开地址 a 和 b 之间所有的连接，在 Heal 之前它们不能再互相连接
+func (n *MemNetwork) Partition(a, b string) {
+	n.mu.Lock()
+	n.partitions[link(a, b)] = true
+
+	var cut []*memConn
+	for c := range n.conns {
+		if link(c.local, c.remote) == link(a, b) {
+			cut = append(cut, c)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, c := range cut {
+		c.Close()
+	}
+}
+
+// Heal 恢复地址 a 和 b 之间的连通
+func (n *MemNetwork) Heal(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.partitions, link(a, b))
+}
+
+// link 返回一对地址的无序表示
+func link(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+func (n *MemNetwork) listen(t *MemTransport) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.transports[t.ListenAddr]; ok {
+		return fmt.Errorf("%w: %s", ErrAddrInUse, t.ListenAddr)
+	}
+	n.transports[t.ListenAddr] = t
+
+	return nil
+}
+
+func (n *MemNetwork) unlisten(t *MemTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.transports[t.ListenAddr] == t {
+		delete(n.transports, t.ListenAddr)
+	}
+}
+
+// dial 在 from 和监听 to 的 transport 之间建立一个连接，返回双方的连接和接受连接的 transport
+func (n *MemNetwork) dial(from, to string) (*memConn, *memConn, *MemTransport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	remote, ok := n.transports[to]
+	if !ok || n.partitions[link(from, to)] {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrUnreachable, to)
+	}
+
+	n.nextConn++
+	c1, c2 := net.Pipe()
+	local := newMemConn(c1, n, from, to, memAddr(to))
+	accepted := newMemConn(c2, n, to, from, memAddr(fmt.Sprintf("%s#%d", from, n.nextConn)))
+	n.conns[local] = struct{}{}
+	n.conns[accepted] = struct{}{}
+
+	return local, accepted, remote, nil
+}
+
+// drop 决定是否丢弃一条消息
+func (n *MemNetwork) drop() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.dropRate > 0 && n.rand.Float64() < n.dropRate
+}
+
+func (n *MemNetwork) delay() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.latency
+}
+
+// memAddr 是内存网络上的地址
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memSendBuffer 是内存网络上每个连接的发送缓冲区大小。和 TCP 的发送缓冲区一样，
+// 对端还没有开始读取时，双方也可以先写入一些数据而不会互相阻塞
+const memSendBuffer = 1 << 20
+
+// memConn 是内存网络上一个连接的一端。写入的数据先放进发送缓冲区，
+// 由单独的 goroutine 在网络的延迟之后写入 net.Pipe
+type memConn struct {
+	net.Conn
+	network *MemNetwork
+	// local 和 remote 是连接两端的 transport 的监听地址
+	local  string
+	remote string
+	// remoteAddr 是 RemoteAddr 返回的地址，接受连接的一端看到的是一个临时地址
+	remoteAddr net.Addr
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []memChunk
+	buffered int
+	err      error
+}
+
+// memChunk 是一次写入的数据，在 deliverAt 之后才交给对端
+type memChunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+func newMemConn(conn net.Conn, network *MemNetwork, local, remote string, remoteAddr net.Addr) *memConn {
+	c := &memConn{Conn: conn, network: network, local: local, remote: remote, remoteAddr: remoteAddr}
+	c.cond = sync.NewCond(&c.mu)
+	go c.pump()
+
+	return c
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	deliverAt := time.Now().Add(c.network.delay())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.buffered >= memSendBuffer && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	c.queue = append(c.queue, memChunk{data: append([]byte(nil), b...), deliverAt: deliverAt})
+	c.buffered += len(b)
+	c.cond.Broadcast()
+
+	return len(b), nil
+}
+
+// pump 按顺序把发送缓冲区中的数据写入 net.Pipe，直到连接关闭
+func (c *memConn) pump() {
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && c.err == nil {
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			c.mu.Unlock()
+			return
+		}
+		chunk := c.queue[0]
+		c.mu.Unlock()
+
+		time.Sleep(time.Until(chunk.deliverAt))
+
+		if _, err := c.Conn.Write(chunk.data); err != nil {
+			c.Close()
+			return
+		}
+
+		c.mu.Lock()
+		c.queue = c.queue[1:]
+		c.buffered -= len(chunk.data)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+func (c *memConn) Close() error {
+	c.network.mu.Lock()
+	delete(c.network.conns, c)
+	c.network.mu.Unlock()
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return memAddr(c.local)
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+type MemTransportOpts struct {
+	// ListenAddr 是 transport 在内存网络上的地址，可以是任意的字符串
+	ListenAddr string
+	Network    *MemNetwork
+	// HandshakeFunc 为空时不做握手
+	HandshakeFunc HandshakeFunc
+	// Decoder 为空时使用 DefaultDecoder
+	Decoder          Decoder
+	OnPeer           func(Peer) error
+	OnPeerDisconnect func(Peer)
+	// HandshakeTimeout 是协商协议版本和握手时各自等待对端的最长时间
+	HandshakeTimeout time.Duration
+}
+
+// MemTransport 是内存网络上的 Transport，对端和 TCPTransport 的对端一样支持消息和多路复用的流
+type MemTransport struct {
+	MemTransportOpts
+	rpcChan chan RPC
+	// wrapConn 由 WrapConns 设置，包装新建立的连接
+	wrapConn func(net.Conn) net.Conn
+}
+
+// NewMemTransport 创建一个新的 MemTransport
+func NewMemTransport(opts MemTransportOpts) *MemTransport {
+	if opts.HandshakeFunc == nil {
+		opts.HandshakeFunc = NOPHandshakeFunc
+	}
+
+	if opts.Decoder == nil {
+		opts.Decoder = DefaultDecoder{}
+	}
+
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	return &MemTransport{
+		MemTransportOpts: opts,
+		rpcChan:          make(chan RPC, 1024),
+	}
+}
+
+// Addr 实现 Transport 的接口，返回监听地址
+func (t *MemTransport) Addr() string {
+	return t.ListenAddr
+}
+
+// Consume 实现 Transport 的接口，返回一个只读 channel 用于接收对端的消息
+func (t *MemTransport) Consume() <-chan RPC {
+	return t.rpcChan
+}
+
+// ListenAndAccept 实现 Transport 的接口，在内存网络上监听 ListenAddr
+func (t *MemTransport) ListenAndAccept() error {
+	return t.Network.listen(t)
+}
+
+// WrapConns 实现 ConnWrapper 接口
+func (t *MemTransport) WrapConns(wrap func(net.Conn) net.Conn) {
+	t.wrapConn = chainWrap(t.wrapConn, wrap)
+}
+
+// SetHandshakeTimeout 实现 HandshakeConfigurer 接口
+func (t *MemTransport) SetHandshakeTimeout(d time.Duration) {
+	t.HandshakeTimeout = d
+}
+
+// Close 实现 Transport 的接口，停止监听，已经建立的连接不受影响
+func (t *MemTransport) Close() error {
+	t.Network.unlisten(t)
+	return nil
+}
+
+// Dial 实现 Transport 的接口，连接内存网络上的另一个 transport
+// 和 TCPTransport 一样，返回 nil 说明对端已经交给了 OnPeer
+func (t *MemTransport) Dial(addr string) error {
+	local, accepted, remote, err := t.Network.dial(t.ListenAddr, addr)
+	if err != nil {
+		return err
+	}
+
+	go handleConn(accepted, remote.peerConfig())
+
+	return startPeer(local, t.peerConfig())
+}
+
+// peerConfig 返回建立对端连接时使用的设置，交给上层的消息按照网络的设置丢弃一部分
+func (t *MemTransport) peerConfig() peerConfig {
+	return peerConfig{
+		handshake:        t.HandshakeFunc,
+		handshakeTimeout: t.HandshakeTimeout,
+		decoder:          t.Decoder,
+		wrapConn:         t.wrapConn,
+		onPeer:           t.OnPeer,
+		onPeerDisconnect: t.OnPeerDisconnect,
+		deliver: func(rpc RPC) {
+			if t.Network.drop() {
+				slog.Debug("MemTransport dropped message", "from", rpc.From, "to", t.ListenAddr)
+				return
+			}
+			t.rpcChan <- rpc
+		},
+	}
+}
@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memPair 在内存网络上创建两个 transport，返回它们和 a 连接 b 之后双方看到的对端
+// onDisconnect 在 b 的对端断开时被调用
+func memPair(t *testing.T, network *MemNetwork, onDisconnect func(Peer)) (*MemTransport, *MemTransport, Peer, Peer) {
+	connected := make(chan Peer, 1)
+	accepted := make(chan Peer, 1)
+
+	a := NewMemTransport(MemTransportOpts{
+		ListenAddr: "a",
+		Network:    network,
+		OnPeer: func(p Peer) error {
+			connected <- p
+			return nil
+		},
+	})
+	b := NewMemTransport(MemTransportOpts{
+		ListenAddr: "b",
+		Network:    network,
+		OnPeer: func(p Peer) error {
+			accepted <- p
+			return nil
+		},
+		OnPeerDisconnect: onDisconnect,
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	assert.Nil(t, b.ListenAndAccept())
+	assert.Nil(t, a.Dial("b"))
+
+	return a, b, <-connected, <-accepted
+}
+
+func TestMemTransport(t *testing.T) {
+	t.Parallel()
+
+	network := NewMemNetwork(1)
+	a, b, toB, toA := memPair(t, network, nil)
+
+	assert.Equal(t, "b", toB.RemoteAddr().String())
+	assert.True(t, toB.Outbound())
+	assert.False(t, toA.Outbound())
+
+	// 地址只能被监听一次
+	assert.True(t, errors.Is(NewMemTransport(MemTransportOpts{ListenAddr: "a", Network: network}).ListenAndAccept(), ErrAddrInUse))
+	assert.True(t, errors.Is(a.Dial("nowhere"), ErrUnreachable))
+
+	assert.Nil(t, toB.Send(EncodeMessage([]byte("hello"))))
+	rpc := <-b.Consume()
+	assert.Equal(t, "hello", string(rpc.Payload))
+	assert.Equal(t, toA.RemoteAddr().String(), rpc.From)
+
+	// 流和 TCPTransport 上的一样工作
+	st, err := toA.OpenStream()
+	assert.Nil(t, err)
+	go func() {
+		st.Write([]byte("over a pipe"))
+		st.Close()
+	}()
+	rst, err := toB.AcceptStream()
+	assert.Nil(t, err)
+	data, err := io.ReadAll(rst)
+	assert.Nil(t, err)
+	assert.Equal(t, "over a pipe", string(data))
+
+	assert.Nil(t, toA.Send(EncodeMessage([]byte("reply"))))
+	assert.Equal(t, "reply", string((<-a.Consume()).Payload))
+}
+
+func TestMemNetworkFaults(t *testing.T) {
+	t.Parallel()
+
+	network := NewMemNetwork(1)
+	disconnected := make(chan Peer, 2)
+
+	_, b, toB, _ := memPair(t, network, func(p Peer) { disconnected <- p })
+
+	// 丢弃所有的消息，流不受影响
+	network.SetDropRate(1)
+	assert.Nil(t, toB.Send(EncodeMessage([]byte("lost"))))
+	st, err := toB.OpenStream()
+	assert.Nil(t, err)
+	assert.Nil(t, st.Close())
+	select {
+	case <-b.Consume():
+		t.Fatal("message was not dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	network.SetDropRate(0)
+	network.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	assert.Nil(t, toB.Send(EncodeMessage([]byte("slow"))))
+	assert.Equal(t, "slow", string((<-b.Consume()).Payload))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	network.SetLatency(0)
+
+	// 分区断开已有的连接，并且不能再建立新的连接
+	network.Partition("a", "b")
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("partition did not close the connection")
+	}
+	assert.NotNil(t, toB.Send(EncodeMessage([]byte("partitioned"))))
+
+	a2 := NewMemTransport(MemTransportOpts{ListenAddr: "a", Network: network})
+	assert.True(t, errors.Is(a2.Dial("b"), ErrUnreachable))
+
+	network.Heal("a", "b")
+	assert.Nil(t, a2.Dial("b"))
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	network := NewMemNetwork(1)
+	// b 在握手时一直等待 a 发来的数据
+	stalled := func(peer Peer) error {
+		_, err := io.ReadFull(peer, make([]byte, 1))
+		return err
+	}
+	a := NewMemTransport(MemTransportOpts{ListenAddr: "a", Network: network, HandshakeFunc: stalled})
+	b := NewMemTransport(MemTransportOpts{ListenAddr: "b", Network: network, HandshakeFunc: stalled})
+	a.SetHandshakeTimeout(100 * time.Millisecond)
+	b.SetHandshakeTimeout(100 * time.Millisecond)
+	assert.Nil(t, b.ListenAndAccept())
+
+	start := time.Now()
+	assert.NotNil(t, a.Dial("b"))
+	assert.Less(t, time.Since(start), defaultHandshakeTimeout)
+}
@@ -1,13 +1,32 @@
 package p2p
 
+// 帧的类型，IncomingMessage 是交给上层的消息，其他的是流的控制和数据帧
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+	// StreamOpen 打开一个新的流
+	StreamOpen = 0x3
+	// StreamData 携带流的数据
+	StreamData = 0x4
+	// StreamWindow 增加对端在这个流上的发送窗口
+	StreamWindow = 0x5
+	// StreamClose 关闭流的一个方向，对端读完之前发送的数据后读到 io.EOF
+	StreamClose = 0x6
+	// StreamReset 立即中止流的两个方向
+	StreamReset = 0x7
 )
 
 // RPC 保存网络中两个节点间正在传输的任何消息
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+	// Type 是帧的类型，流帧的 StreamID 是它所属的流
+	Type     byte
+	StreamID uint64
+	// Window 是 StreamWindow 帧增加的发送窗口
+	Window uint64
+}
+
+// isStreamFrame 判断一个帧是否属于某个流
+func isStreamFrame(frameType byte) bool {
+	return frameType >= StreamOpen && frameType <= StreamReset
 }
@@ -0,0 +1,381 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// streamWindow 是每个流的接收窗口，发送方最多可以发送这么多还没有被对端读取的数据
+	streamWindow = 256 << 10
+	// maxStreamFrame 是一个数据帧最多携带的数据，大的写入被拆成多个帧，其他流的帧可以插在中间
+	maxStreamFrame = 32 << 10
+	// acceptBacklog 是等待 AcceptStream 的流的最大数量，超过时新打开的流被重置
+	acceptBacklog = 64
+)
+
+// ErrStreamReset 表示流被本端或者对端重置
+var ErrStreamReset = errors.New("p2p: stream reset")
+
+// muxer 在一个连接上复用多个流。连接的读循环把流帧交给 handle，handle 从不阻塞，
+// 因此一个流上的数据没有被读取时，其他的流和消息照常传输
+type muxer struct {
+	// write 原子地写入一帧
+	write func([]byte) error
+
+	mu      sync.Mutex
+	streams map[uint64]*stream
+	// nextID 是本端下一个打开的流的 ID，发起连接的一端使用奇数，另一端使用偶数
+	nextID uint64
+
+	// resets 是等待发送的重置帧对应的流，读循环中重置的流不能阻塞在写入上，
+	// 由 flushResets 在读循环之外依次发送，resetting 表示它正在运行
+	resets    []uint64
+	resetting bool
+
+	acceptCh  chan *stream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuxer(write func([]byte) error, outbound bool) *muxer {
+	m := &muxer{
+		write:    write,
+		streams:  make(map[uint64]*stream),
+		nextID:   2,
+		acceptCh: make(chan *stream, acceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	if outbound {
+		m.nextID = 1
+	}
+
+	return m
+}
+
+// open 打开一个新的流
+func (m *muxer) open() (*stream, error) {
+	m.mu.Lock()
+	select {
+	case <-m.closed:
+		m.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+
+	st := newStream(m, m.nextID)
+	m.streams[st.id] = st
+	m.nextID += 2
+	m.mu.Unlock()
+
+	if err := m.write(encodeStreamFrame(StreamOpen, st.id, 0, nil)); err != nil {
+		m.remove(st.id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// accept 等待对端打开一个新的流，连接关闭后返回 net.ErrClosed
+func (m *muxer) accept() (*stream, error) {
+	select {
+	case st := <-m.acceptCh:
+		return st, nil
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// handle 处理对端发来的一个流帧
+func (m *muxer) handle(rpc RPC) {
+	if rpc.Type == StreamOpen {
+		m.mu.Lock()
+		if _, ok := m.streams[rpc.StreamID]; ok {
+			m.mu.Unlock()
+			return
+		}
+		st := newStream(m, rpc.StreamID)
+		m.streams[st.id] = st
+		m.mu.Unlock()
+
+		select {
+		case m.acceptCh <- st:
+		default:
+			st.abort()
+		}
+		return
+	}
+
+	m.mu.Lock()
+	st, ok := m.streams[rpc.StreamID]
+	m.mu.Unlock()
+
+	// 本端已经重置了这个流，丢弃随后到达的帧
+	if !ok {
+		return
+	}
+
+	switch rpc.Type {
+	case StreamData:
+		st.receive(rpc.Payload)
+	case StreamWindow:
+		st.grant(int(rpc.Window))
+	case StreamClose:
+		st.remoteClose()
+	case StreamReset:
+		st.fail(ErrStreamReset)
+		m.remove(st.id)
+	}
+}
+
+// queueReset 把流 id 的重置帧交给 flushResets 发送，不会阻塞
+func (m *muxer) queueReset(id uint64) {
+	m.mu.Lock()
+	m.resets = append(m.resets, id)
+	start := !m.resetting
+	m.resetting = true
+	m.mu.Unlock()
+
+	if start {
+		go m.flushResets()
+	}
+}
+
+// flushResets 依次发送排队的重置帧，队列空了之后退出
+func (m *muxer) flushResets() {
+	for {
+		m.mu.Lock()
+		ids := m.resets
+		m.resets = nil
+		if len(ids) == 0 {
+			m.resetting = false
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+
+		// 写入失败时连接已经断开，对端的流会随着连接一起失败
+		for _, id := range ids {
+			m.write(encodeStreamFrame(StreamReset, id, 0, nil))
+		}
+	}
+}
+
+// remove 不再跟踪一个流，之后它的帧都被丢弃
+func (m *muxer) remove(id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.streams, id)
+}
+
+// close 在连接断开后调用，所有的流和 accept 都返回 net.ErrClosed
+func (m *muxer) close() {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		close(m.closed)
+		streams := m.streams
+		m.streams = make(map[uint64]*stream)
+		m.mu.Unlock()
+
+		for _, st := range streams {
+			st.fail(net.ErrClosed)
+		}
+	})
+}
+
+// stream 实现 Stream 接口
+type stream struct {
+	id uint64
+	m  *muxer
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// buf 保存已经收到还没有被读取的数据
+	buf bytes.Buffer
+	// unacked 是已经被读取但还没有归还给对端的发送窗口
+	unacked int
+	// sendWindow 是本端还可以发送的字节数
+	sendWindow int
+	// localClosed 和 remoteClosed 分别表示本端和对端已经关闭了写入
+	localClosed  bool
+	remoteClosed bool
+	// err 不为空时流已经被重置或者连接已经断开
+	err error
+}
+
+func newStream(m *muxer, id uint64) *stream {
+	st := &stream{id: id, m: m, sendWindow: streamWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID 实现 Stream 接口，返回流的 ID
+func (s *stream) ID() uint64 {
+	return s.id
+}
+
+// Read 实现 Stream 接口，读取对端发来的数据，对端关闭写入并且数据读完后返回 io.EOF
+func (s *stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return 0, err
+	}
+	if s.buf.Len() == 0 {
+		s.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	n, _ := s.buf.Read(p)
+	s.unacked += n
+
+	// 读走一半窗口的数据后归还给对端，避免每次读取都发送一帧
+	var grant int
+	if s.unacked >= streamWindow/2 && !s.remoteClosed {
+		grant, s.unacked = s.unacked, 0
+	}
+	s.mu.Unlock()
+
+	if grant > 0 {
+		s.m.write(encodeStreamFrame(StreamWindow, s.id, uint64(grant), nil))
+	}
+
+	return n, nil
+}
+
+// Write 实现 Stream 接口，发送窗口用完时阻塞，直到对端读取了数据
+func (s *stream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow == 0 && s.err == nil && !s.localClosed {
+			s.cond.Wait()
+		}
+
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.localClosed {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+
+		n := min(len(p), s.sendWindow, maxStreamFrame)
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		if err := s.m.write(encodeStreamFrame(StreamData, s.id, 0, p[:n])); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close 实现 Stream 接口，关闭本端的写入，之后仍然可以读取对端发来的数据
+func (s *stream) Close() error {
+	s.mu.Lock()
+	if s.localClosed || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	done := s.remoteClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.m.remove(s.id)
+	}
+
+	return s.m.write(encodeStreamFrame(StreamClose, s.id, 0, nil))
+}
+
+// Reset 实现 Stream 接口，立即中止流的两个方向，双方还没有完成的读写都返回 ErrStreamReset
+func (s *stream) Reset() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.err = ErrStreamReset
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.m.remove(s.id)
+
+	return s.m.write(encodeStreamFrame(StreamReset, s.id, 0, nil))
+}
+
+// abort 在读循环中重置流，和 Reset 一样中止两个方向，但是重置帧排队发送，读循环不会阻塞在写入上
+func (s *stream) abort() {
+	s.fail(ErrStreamReset)
+	s.m.remove(s.id)
+	s.m.queueReset(s.id)
+}
+
+// receive 保存对端发来的数据，对端超出窗口发送数据时重置流
+func (s *stream) receive(data []byte) {
+	s.mu.Lock()
+	if s.err != nil || s.remoteClosed {
+		s.mu.Unlock()
+		return
+	}
+
+	if s.buf.Len()+s.unacked+len(data) > streamWindow {
+		s.mu.Unlock()
+		s.abort()
+		return
+	}
+
+	s.buf.Write(data)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// grant 增加本端的发送窗口
+func (s *stream) grant(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sendWindow += n
+	s.cond.Broadcast()
+}
+
+// remoteClose 记录对端已经关闭了写入，两个方向都关闭后不再跟踪这个流
+func (s *stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteClosed = true
+	done := s.localClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.m.remove(s.id)
+	}
+}
+
+// fail 让流上所有还没有完成和之后的读写都返回 err
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
@@ -0,0 +1,239 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// streamPair 在本地建立一个 TCP 连接，返回发起连接和接受连接的两个对端，以及接受连接的 transport
+func streamPair(t *testing.T) (Peer, Peer, *TCPTransport) {
+	accepted := make(chan Peer, 1)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			accepted <- p
+			return nil
+		},
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	t.Cleanup(func() { server.Close() })
+
+	connected := make(chan Peer, 1)
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			connected <- p
+			return nil
+		},
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	local, remote := <-connected, <-accepted
+	t.Cleanup(func() { local.Close() })
+
+	return local, remote, server
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	local, remote, _ := streamPair(t)
+
+	// 对端把每个流中的数据原样发回
+	go func() {
+		for {
+			st, err := remote.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data := bytes.Repeat([]byte(fmt.Sprintf("stream %d ", i)), 10000)
+			st, err := local.OpenStream()
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+
+			echoed, err := io.ReadAll(st)
+			assert.Nil(t, err)
+			assert.Equal(t, data, echoed)
+		}()
+	}
+	wg.Wait()
+
+	// 发起连接的一端使用奇数 ID
+	st, err := local.OpenStream()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), st.ID()%2)
+	st.Reset()
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	local, remote, server := streamPair(t)
+
+	// 一个超过窗口的传输在对端读取之前阻塞
+	large := make([]byte, 4*streamWindow)
+	rand.Read(large)
+
+	bulk, err := local.OpenStream()
+	assert.Nil(t, err)
+	written := make(chan error, 1)
+	go func() {
+		_, err := bulk.Write(large)
+		bulk.Close()
+		written <- err
+	}()
+
+	bulkRemote, err := remote.AcceptStream()
+	assert.Nil(t, err)
+
+	select {
+	case <-written:
+		t.Fatal("write exceeded the stream window")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 其他的流和消息不受影响
+	small, err := local.OpenStream()
+	assert.Nil(t, err)
+	_, err = small.Write([]byte("small"))
+	assert.Nil(t, err)
+	assert.Nil(t, small.Close())
+
+	smallRemote, err := remote.AcceptStream()
+	assert.Nil(t, err)
+	b, err := io.ReadAll(smallRemote)
+	assert.Nil(t, err)
+	assert.Equal(t, "small", string(b))
+
+	assert.Nil(t, local.Send(EncodeMessage([]byte("control"))))
+	select {
+	case rpc := <-server.Consume():
+		assert.Equal(t, "control", string(rpc.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("message was blocked by a stalled stream")
+	}
+
+	// 读取之后发送方继续发送
+	received, err := io.ReadAll(bulkRemote)
+	assert.Nil(t, err)
+	assert.Equal(t, large, received)
+	assert.Nil(t, <-written)
+}
+
+func TestStreamCloseAndReset(t *testing.T) {
+	local, remote, _ := streamPair(t)
+
+	// Close 只关闭一个方向
+	st, err := local.OpenStream()
+	assert.Nil(t, err)
+	_, err = st.Write([]byte("request"))
+	assert.Nil(t, err)
+	assert.Nil(t, st.Close())
+
+	rst, err := remote.AcceptStream()
+	assert.Nil(t, err)
+	b, err := io.ReadAll(rst)
+	assert.Nil(t, err)
+	assert.Equal(t, "request", string(b))
+
+	_, err = rst.Write([]byte("response"))
+	assert.Nil(t, err)
+	assert.Nil(t, rst.Close())
+
+	b, err = io.ReadAll(st)
+	assert.Nil(t, err)
+	assert.Equal(t, "response", string(b))
+
+	// Reset 中止对端的读写，不影响其他的流
+	aborted, err := local.OpenStream()
+	assert.Nil(t, err)
+	other, err := local.OpenStream()
+	assert.Nil(t, err)
+
+	rAborted, err := remote.AcceptStream()
+	assert.Nil(t, err)
+	rOther, err := remote.AcceptStream()
+	assert.Nil(t, err)
+
+	assert.Nil(t, rAborted.Reset())
+	_, err = io.ReadAll(aborted)
+	assert.True(t, errors.Is(err, ErrStreamReset))
+	_, err = rAborted.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrStreamReset))
+
+	_, err = other.Write([]byte("still open"))
+	assert.Nil(t, err)
+	assert.Nil(t, other.Close())
+	b, err = io.ReadAll(rOther)
+	assert.Nil(t, err)
+	assert.Equal(t, "still open", string(b))
+}
+
+func TestMuxerResetDoesNotBlockReadLoop(t *testing.T) {
+	// 连接的写入被阻塞时，读循环中重置的流依然不会阻塞 handle
+	release := make(chan struct{})
+	written := make(chan []byte, acceptBacklog+2)
+	m := newMuxer(func(b []byte) error {
+		<-release
+		written <- b
+		return nil
+	}, false)
+
+	handled := make(chan struct{})
+	go func() {
+		// 超出等待 AcceptStream 的数量的流被重置
+		for id := uint64(1); id <= 2*(acceptBacklog+1); id += 2 {
+			m.handle(RPC{Type: StreamOpen, StreamID: id})
+		}
+		// 超出接收窗口的流被重置
+		m.handle(RPC{Type: StreamData, StreamID: 1, Payload: make([]byte, streamWindow+1)})
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handle blocked on a reset")
+	}
+
+	st, err := m.accept()
+	assert.Nil(t, err)
+	_, err = st.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrStreamReset))
+
+	close(release)
+	for _, id := range []uint64{2*acceptBacklog + 1, 1} {
+		select {
+		case b := <-written:
+			assert.Equal(t, encodeStreamFrame(StreamReset, id, 0, nil), b)
+		case <-time.After(time.Second):
+			t.Fatalf("reset of stream %d was not sent", id)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// certificateValidity 是节点自签名证书的有效期，证书只用于加密会话，对端不检查证书链
+const certificateValidity = 10 * 365 * 24 * time.Hour
+
+// Certificate 返回一个由身份的私钥签名的自签名证书，证书的公钥就是身份的公钥
+func (i *Identity) Certificate() (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: i.ID()},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, i.PublicKey(), i.privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: i.privateKey}, nil
+}
+
+// secureSession 在 conn 上建立一个 TLS 1.3 会话，由本端发起的连接作为客户端。
+// 每个连接都通过临时的密钥交换得到自己的会话密钥。双方都要出示证书，
+// expected 不为空时，对端证书的公钥必须是握手时认证过的公钥，否则会话可能被中间人截获
+func secureSession(conn net.Conn, outbound bool, cert tls.Certificate, expected ed25519.PublicKey, timeout time.Duration) (*tls.Conn, ed25519.PublicKey, error) {
+	var remote ed25519.PublicKey
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// 证书是自签名的，由 VerifyPeerCertificate 检查证书的公钥
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate")
+			}
+
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+
+			key, ok := cert.PublicKey.(ed25519.PublicKey)
+			if !ok {
+				return fmt.Errorf("certificate key is %T, not ed25519", cert.PublicKey)
+			}
+			if expected != nil && !key.Equal(expected) {
+				return fmt.Errorf("certificate key %s does not match authenticated key %s", KeyID(key), KeyID(expected))
+			}
+
+			remote = key
+			return nil
+		},
+	}
+
+	var tlsConn *tls.Conn
+	if outbound {
+		tlsConn = tls.Client(conn, config)
+	} else {
+		tlsConn = tls.Server(conn, config)
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, fmt.Errorf("%w: tls: %v", ErrAuthenticationFailed, err)
+	}
+
+	return tlsConn, remote, nil
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPTransportTLS(t *testing.T) {
+	alice, err := NewIdentity()
+	assert.Nil(t, err)
+	bob, err := NewIdentity()
+	assert.Nil(t, err)
+	allowlist := NewAllowlist(alice.PublicKey(), bob.PublicKey())
+
+	accepted := make(chan Peer, 1)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: AuthHandshakeFunc(alice, allowlist),
+		Decoder:       DefaultDecoder{},
+		TLSIdentity:   alice,
+		OnPeer: func(p Peer) error {
+			accepted <- p
+			return nil
+		},
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	connected := make(chan Peer, 1)
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: AuthHandshakeFunc(bob, allowlist),
+		Decoder:       DefaultDecoder{},
+		TLSIdentity:   bob,
+		OnPeer: func(p Peer) error {
+			connected <- p
+			return nil
+		},
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	peer := <-connected
+	defer peer.Close()
+	_, ok := peer.(*TCPPeer).Conn.(*tls.Conn)
+	assert.True(t, ok)
+	assert.Equal(t, alice.ID(), KeyID(peer.PublicKey()))
+	assert.Equal(t, bob.ID(), KeyID((<-accepted).PublicKey()))
+
+	// 加密会话对上层透明
+	assert.Nil(t, peer.Send(EncodeMessage([]byte("hello over tls"))))
+	select {
+	case rpc := <-server.Consume():
+		assert.Equal(t, "hello over tls", string(rpc.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestSecureSessionRejectsMismatchedCertificate(t *testing.T) {
+	alice, err := NewIdentity()
+	assert.Nil(t, err)
+	bob, err := NewIdentity()
+	assert.Nil(t, err)
+	mallory, err := NewIdentity()
+	assert.Nil(t, err)
+
+	aliceCert, err := alice.Certificate()
+	assert.Nil(t, err)
+	malloryCert, err := mallory.Certificate()
+	assert.Nil(t, err)
+
+	// 握手时认证的是 bob，TLS 会话中出示的却是 mallory 的证书
+	c1, c2 := net.Pipe()
+	go func() {
+		secureSession(c2, false, malloryCert, nil, time.Second)
+		c2.Close()
+	}()
+
+	_, _, err = secureSession(c1, true, aliceCert, bob.PublicKey(), time.Second)
+	assert.True(t, errors.Is(err, ErrAuthenticationFailed))
+}
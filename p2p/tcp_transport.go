@@ -1,13 +1,18 @@
 package p2p
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"log/slog"
 	"net"
 	"sync"
+	"time"
 )
 
+// defaultHandshakeTimeout 是协商协议版本和握手时等待对端的默认超时时间
+const defaultHandshakeTimeout = 5 * time.Second
+
 // TCPPeer 代表一个 TCP 连接的远端节点
 type TCPPeer struct {
 	net.Conn // 对端的连接
@@ -16,24 +21,69 @@ type TCPPeer struct {
 	// 如果是 false, 则是接收连接的一方
 	outbound bool
 
-	wg *sync.WaitGroup
+	// publicKey 是对端在握手时证明持有的公钥
+	publicKey ed25519.PublicKey
+
+	// writeMu 保证每一帧被完整地写入连接，多个流和消息可以并发地发送
+	writeMu sync.Mutex
+	mux     *muxer
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{
+	p := &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
 	}
+	p.mux = newMuxer(p.writeFrame, outbound)
+
+	return p
+}
+
+// Outbound 实现 Peer 接口，返回这个连接是否由本端发起
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// PublicKey 实现 Peer 接口，返回对端在握手时证明持有的公钥
+func (p *TCPPeer) PublicKey() ed25519.PublicKey {
+	return p.publicKey
+}
+
+// setPublicKey 记录认证握手确认的对端公钥
+func (p *TCPPeer) setPublicKey(key ed25519.PublicKey) {
+	p.publicKey = key
 }
 
-// CloseStream 实现 TCPPeer 接口，关闭流
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// OpenStream 实现 Peer 接口，打开一个新的流
+func (p *TCPPeer) OpenStream() (Stream, error) {
+	st, err := p.mux.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
 }
 
-// Send 实现 TCPPeer 接口，发送数据
+// AcceptStream 实现 Peer 接口，等待对端打开一个新的流
+func (p *TCPPeer) AcceptStream() (Stream, error) {
+	st, err := p.mux.accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Send 实现 TCPPeer 接口，发送一个已经编码好的帧
 func (p *TCPPeer) Send(b []byte) error {
+	return p.writeFrame(b)
+}
+
+// writeFrame 原子地写入一帧
+func (p *TCPPeer) writeFrame(b []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
 	_, err := p.Conn.Write(b)
 	return err
 }
@@ -43,16 +93,34 @@ type TCPTransportOpts struct {
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect 在一个完成握手并通过 OnPeer 的对端断开连接后被调用
+	OnPeerDisconnect func(Peer)
+	// HandshakeTimeout 是协商协议版本、握手和建立 TLS 会话时各自等待对端的最长时间
+	HandshakeTimeout time.Duration
+	// TLSIdentity 不为空时，握手之后用这个身份的自签名证书将连接包装成加密的 TLS 会话，
+	// 应该和认证握手使用同一个身份
+	TLSIdentity *Identity
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcChan  chan RPC
+	// wrapConn 由 WrapConns 设置，包装新建立的连接
+	wrapConn func(net.Conn) net.Conn
+
+	// certOnce 保证自签名证书只生成一次
+	certOnce sync.Once
+	cert     tls.Certificate
+	certErr  error
 }
 
 // NewTCPTransport 创建一个新的 TCPTransport
 func NewTCPTransport(Ops TCPTransportOpts) *TCPTransport {
+	if Ops.HandshakeTimeout == 0 {
+		Ops.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
 	return &TCPTransport{
 		TCPTransportOpts: Ops,
 		rpcChan:          make(chan RPC, 1024),
@@ -69,20 +137,30 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcChan
 }
 
+// WrapConns 实现 ConnWrapper 接口
+func (t *TCPTransport) WrapConns(wrap func(net.Conn) net.Conn) {
+	t.wrapConn = chainWrap(t.wrapConn, wrap)
+}
+
+// SetHandshakeTimeout 实现 HandshakeConfigurer 接口
+func (t *TCPTransport) SetHandshakeTimeout(d time.Duration) {
+	t.HandshakeTimeout = d
+}
+
 // Close 实现 Transport 的接口，关闭监听
 func (t *TCPTransport) Close() error {
 	return t.listener.Close()
 }
 
 // Dial 实现 Transport 的接口，发起连接
+// 协议协商和握手都在返回之前完成，返回 nil 说明对端已经交给了 OnPeer
 func (t *TCPTransport) Dial(addr string) error {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	go t.handleConn(conn, true)
-	return nil
+	return startPeer(conn, t.peerConfig())
 }
 
 // ListenAndAccept 实现 Transport 的接口，监听并接受连接
@@ -110,49 +188,47 @@ func (t *TCPTransport) startAcceptLoop() {
 			return
 		}
 
-		go t.handleConn(conn, false)
+		go handleConn(conn, t.peerConfig())
 	}
 }
 
-func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
-
-	defer func() {
-		slog.Debug("dropping peer connection", "error", err)
-		conn.Close()
-	}()
-
-	peer := NewTCPPeer(conn, outbound)
-
-	if err = t.HandshakeFunc(peer); err != nil {
-		return
+// peerConfig 返回建立对端连接时使用的设置，需要时在握手之后建立 TLS 会话
+func (t *TCPTransport) peerConfig() peerConfig {
+	cfg := peerConfig{
+		handshake:        t.HandshakeFunc,
+		handshakeTimeout: t.HandshakeTimeout,
+		decoder:          t.Decoder,
+		wrapConn:         t.wrapConn,
+		onPeer:           t.OnPeer,
+		onPeerDisconnect: t.OnPeerDisconnect,
+		deliver: func(rpc RPC) {
+			t.rpcChan <- rpc
+			slog.Debug("TCPTransport received message", "rpc", rpc)
+		},
 	}
-
-	if t.OnPeer != nil {
-		if err = t.OnPeer(peer); err != nil {
-			return
-		}
+	if t.TLSIdentity != nil {
+		cfg.secure = t.secure
 	}
 
-	// 循环读取数据
-	for {
-		rpc := RPC{}
-		err = t.Decoder.Decode(peer.Conn, &rpc)
-		if err != nil {
-			slog.Error("TCPTransport read error", "error", err)
-			return
-		}
+	return cfg
+}
 
-		rpc.From = conn.RemoteAddr().String()
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
-			continue
-		}
+// secure 将对端的连接包装成 TLS 会话，之后所有的读写都经过加密
+// 没有经过认证握手的对端以它在 TLS 握手中证明持有的证书公钥作为它的公钥
+func (t *TCPTransport) secure(peer *TCPPeer) error {
+	t.certOnce.Do(func() {
+		t.cert, t.certErr = t.TLSIdentity.Certificate()
+	})
+	if t.certErr != nil {
+		return t.certErr
+	}
 
-		t.rpcChan <- rpc
-		slog.Debug("TCPTransport received message", "rpc", rpc)
+	conn, key, err := secureSession(peer.Conn, peer.outbound, t.cert, peer.publicKey, t.HandshakeTimeout)
+	if err != nil {
+		return err
 	}
+
+	peer.Conn = conn
+	peer.publicKey = key
+	return nil
 }
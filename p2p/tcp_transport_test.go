@@ -3,6 +3,7 @@ package p2p
 import (
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestNewTCPTransport(t *testing.T) {
@@ -16,3 +17,37 @@ func TestNewTCPTransport(t *testing.T) {
 
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestTCPTransportOnPeerDisconnect(t *testing.T) {
+	disconnected := make(chan Peer, 1)
+
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:       "127.0.0.1:0",
+		HandshakeFunc:    NOPHandshakeFunc,
+		Decoder:          DefaultDecoder{},
+		OnPeerDisconnect: func(p Peer) { disconnected <- p },
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	connected := make(chan Peer, 1)
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			connected <- p
+			return nil
+		},
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	peer := <-connected
+	peer.Close()
+
+	select {
+	case p := <-disconnected:
+		assert.Equal(t, peer.LocalAddr().String(), p.RemoteAddr().String())
+	case <-time.After(time.Second):
+		t.Fatal("OnPeerDisconnect was not called")
+	}
+}
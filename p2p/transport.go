@@ -1,12 +1,37 @@
 package p2p
 
-import "net"
+import (
+	"crypto/ed25519"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
 
 // Peer 是一个代表远端节点的接口
 type Peer interface {
 	net.Conn
 	Send([]byte) error
-	CloseStream()
+	// OpenStream 在连接上打开一个新的流，多个流和消息可以同时在一个连接上传输
+	OpenStream() (Stream, error)
+	// AcceptStream 等待对端打开一个新的流，连接断开后返回错误
+	AcceptStream() (Stream, error)
+	// Outbound 返回这个连接是否由本端发起
+	Outbound() bool
+	// PublicKey 返回对端在握手时证明持有的公钥，没有经过认证时返回 nil
+	PublicKey() ed25519.PublicKey
+}
+
+// Stream 是连接上的一个双向的字节流，每个流有自己的 ID、流量控制窗口，可以独立地关闭。
+// 流用完之后双方都需要调用 Close 或者 Reset
+type Stream interface {
+	io.ReadWriter
+	// Close 关闭本端的写入，对端读完之前发送的数据后读到 io.EOF，本端仍然可以继续读取
+	Close() error
+	// Reset 立即中止流的两个方向，双方还没有完成的读写都返回 ErrStreamReset
+	Reset() error
+	// ID 返回流在连接上的 ID
+	ID() uint64
 }
 
 // Transport 是处理任何远端网络之间节点通信的接口
@@ -18,3 +43,135 @@ type Transport interface {
 	Consume() <-chan RPC
 	Close() error
 }
+
+// ConnWrapper 是可以包装新建立的连接的 Transport，TCPTransport 和 MemTransport 都实现了它
+type ConnWrapper interface {
+	Transport
+	// WrapConns 让之后建立的连接在协商协议之前经过 wrap，之后连接上所有的读写都经过它。
+	// 需要在 ListenAndAccept 和 Dial 之前调用，多次调用时依次包装
+	WrapConns(wrap func(net.Conn) net.Conn)
+}
+
+// HandshakeConfigurer 是可以修改握手超时时间的 Transport，TCPTransport、MemTransport 和 FaultTransport 都实现了它
+type HandshakeConfigurer interface {
+	Transport
+	// SetHandshakeTimeout 修改协商协议版本和握手时等待对端的最长时间，需要在 ListenAndAccept 和 Dial 之前调用
+	SetHandshakeTimeout(time.Duration)
+}
+
+// chainWrap 返回先用 inner 再用 outer 包装连接的函数
+func chainWrap(inner, outer func(net.Conn) net.Conn) func(net.Conn) net.Conn {
+	if inner == nil {
+		return outer
+	}
+
+	return func(conn net.Conn) net.Conn {
+		return outer(inner(conn))
+	}
+}
+
+// peerConfig 是 TCPTransport 和 MemTransport 建立和维护对端连接时共同的设置
+type peerConfig struct {
+	handshake HandshakeFunc
+	// handshakeTimeout 是协商协议版本和握手各自等待对端的最长时间
+	handshakeTimeout time.Duration
+	decoder          Decoder
+	// wrapConn 不为空时在协商协议之前包装新建立的连接
+	wrapConn func(net.Conn) net.Conn
+	// secure 不为空时在握手之后调用，例如把连接包装成 TLS 会话
+	secure           func(*TCPPeer) error
+	onPeer           func(Peer) error
+	onPeerDisconnect func(Peer)
+	// deliver 把对端发来的消息交给上层
+	deliver func(RPC)
+}
+
+// setupPeer 与对端协商协议版本并完成握手，需要时建立加密的会话，成功后将对端交给 onPeer
+func setupPeer(conn net.Conn, outbound bool, cfg peerConfig) (*TCPPeer, error) {
+	if cfg.wrapConn != nil {
+		conn = cfg.wrapConn(conn)
+	}
+	peer := NewTCPPeer(conn, outbound)
+
+	if err := negotiateProtocol(conn, cfg.handshakeTimeout); err != nil {
+		slog.Error("protocol negotiation failed", "remote", conn.RemoteAddr(), "error", err)
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(cfg.handshakeTimeout))
+	err := cfg.handshake(peer)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.secure != nil {
+		if err := cfg.secure(peer); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.onPeer != nil {
+		if err := cfg.onPeer(peer); err != nil {
+			return nil, err
+		}
+	}
+
+	return peer, nil
+}
+
+// startPeer 建立本端发起的连接上的对端，成功后在后台读取它发来的数据，失败时关闭连接
+func startPeer(conn net.Conn, cfg peerConfig) error {
+	peer, err := setupPeer(conn, true, cfg)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go readLoop(peer, cfg)
+	return nil
+}
+
+// handleConn 建立对端接受的连接上的对端并循环读取它发来的数据，建立失败时关闭连接
+func handleConn(conn net.Conn, cfg peerConfig) {
+	peer, err := setupPeer(conn, false, cfg)
+	if err != nil {
+		slog.Debug("dropping peer connection", "error", err)
+		conn.Close()
+		return
+	}
+
+	readLoop(peer, cfg)
+}
+
+// readLoop 循环读取对端发来的数据，消息交给 deliver，流帧交给对端的 muxer，
+// 连接断开后关闭所有的流并调用 onPeerDisconnect
+func readLoop(peer *TCPPeer, cfg peerConfig) {
+	err := readFrames(peer, cfg.decoder, cfg.deliver)
+	slog.Debug("dropping peer connection", "remote", peer.RemoteAddr(), "error", err)
+
+	peer.Close()
+	peer.mux.close()
+
+	if cfg.onPeerDisconnect != nil {
+		cfg.onPeerDisconnect(peer)
+	}
+}
+
+// readFrames 循环读取对端发来的帧，流帧交给对端的 muxer，消息交给 deliver，直到读取出错
+func readFrames(peer *TCPPeer, dec Decoder, deliver func(RPC)) error {
+	for {
+		rpc := RPC{}
+		if err := dec.Decode(peer.Conn, &rpc); err != nil {
+			return err
+		}
+
+		if isStreamFrame(rpc.Type) {
+			peer.mux.handle(rpc)
+			continue
+		}
+
+		rpc.From = peer.RemoteAddr().String()
+		deliver(rpc)
+	}
+}
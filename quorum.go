@@ -0,0 +1,223 @@
+package main
+
+import (
+	"distributed-file-store/p2p"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrQuorumNotReached 表示在超时之前没有足够的副本响应
+	ErrQuorumNotReached = errors.New("quorum not reached")
+	// ErrStaleWrite 表示副本上已经有更新的文件或者墓碑，写入被拒绝
+	ErrStaleWrite = errors.New("replica has a newer version")
+	// ErrReplicasDisagree 表示副本上的文件版本相同但是内容不同，例如其中一个副本的数据已经损坏
+	ErrReplicasDisagree = errors.New("replicas disagree")
+)
+
+// MessageStoreAck 是对带有 RequestID 的 MessageStoreFile 的确认，Err 为空表示文件已经写入磁盘
+type MessageStoreAck struct {
+	RequestID string
+	Err       string
+	// Stale 表示写入因为副本上已经有更新的文件或者墓碑而被拒绝
+	Stale bool
+}
+
+// ackStore 在对端要求确认时回复 MessageStoreAck
+func (s *FileServer) ackStore(peer p2p.Peer, msg MessageStoreFile, err error) error {
+	if len(msg.RequestID) == 0 {
+		return nil
+	}
+
+	ack := MessageStoreAck{RequestID: msg.RequestID}
+	if err != nil {
+		ack.Err = fmt.Sprintf("[%s] store (%s): %v", s.Transport.Addr(), msg.Name, err)
+		ack.Stale = errors.Is(err, ErrStaleWrite)
+	}
+
+	return s.send(peer, &Message{Payload: ack})
+}
+
+// awaitWriteQuorum 等待 sent 个副本节点中有 WriteQuorum-1 个确认写入成功
+func (s *FileServer) awaitWriteQuorum(key string, req *pendingRequest, sent int) error {
+	need := s.WriteQuorum - 1
+	if need <= 0 {
+		return nil
+	}
+
+	if sent < need {
+		return fmt.Errorf("[%s] store (%s): only %d of %d replicas connected: %w", s.Transport.Addr(), key, sent+1, s.WriteQuorum, ErrQuorumNotReached)
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	var (
+		acked int
+		errs  []error
+	)
+	for received := 0; acked < need; received++ {
+		// 剩下的副本全部成功也达不到要求
+		if sent-received < need-acked {
+			errs = append(errs, fmt.Errorf("[%s] store (%s): %d of %d replicas acknowledged: %w", s.Transport.Addr(), key, acked+1, s.WriteQuorum, ErrQuorumNotReached))
+			return errors.Join(errs...)
+		}
+
+		select {
+		case v := <-req.respCh:
+			if ack := v.(MessageStoreAck); ack.Err != "" {
+				errs = append(errs, errors.New(ack.Err))
+				continue
+			}
+			acked++
+		case <-timer.C:
+			return fmt.Errorf("[%s] timed out waiting for store of (%s): %d of %d replicas acknowledged: %w", s.Transport.Addr(), key, acked+1, s.WriteQuorum, ErrQuorumNotReached)
+		case <-s.quitCh:
+			return fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+		}
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreAck(from string, msg MessageStoreAck) error {
+	if req, ok := s.pendingRequest(msg.RequestID); ok {
+		req.deliver(msg)
+	}
+
+	return nil
+}
+
+// quorumGet 比较 ReadQuorum 个副本上的文件版本，返回其中最新的一个
+// 本地的文件不是最新的时候，从有最新版本的对端获取。任何一个副本上和它并发的版本都记录在返回的元数据中。
+// 每个副本都用写入时记录的 SHA-256 校验自己保存的数据，有副本保存的最新版本已经损坏时返回 ErrReplicasDisagree
+func (s *FileServer) quorumGet(key string) (io.Reader, Metadata, error) {
+	var versions []MessageGetFileResponse
+	if meta, err := s.store.Metadata(s.ID, key); err == nil {
+		_, err := s.store.Verify(s.ID, key, nil)
+		versions = append(versions, MessageGetFileResponse{Node: s.ID, Found: true, Metadata: meta, Corrupt: errors.Is(err, ErrChecksumMismatch)})
+	}
+
+	owners, _ := s.replicaPeers(key)
+	need := s.ReadQuorum - len(versions)
+	if len(owners) < need {
+		return nil, Metadata{}, fmt.Errorf("[%s] get (%s): only %d of %d replicas connected: %w", s.Transport.Addr(), key, len(owners)+len(versions), s.ReadQuorum, ErrQuorumNotReached)
+	}
+
+	remote, err := s.readVersions(key, owners, need)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	versions = append(versions, remote...)
+
+	var (
+		latest  MessageGetFileResponse
+		holders []string
+	)
+	for _, v := range versions {
+		switch {
+		case !v.Found:
+		case len(holders) == 0 || v.Metadata.newerThan(latest.Metadata):
+			latest, holders = v, []string{v.Node}
+		case v.Metadata.sameVersion(latest.Metadata):
+			holders = append(holders, v.Node)
+		}
+	}
+
+	if len(holders) == 0 {
+		return nil, Metadata{}, fmt.Errorf("[%s] file (%s) not found on any of %d replicas: %w", s.Transport.Addr(), key, len(versions), ErrFileNotFound)
+	}
+
+	for _, v := range versions {
+		if v.Found && v.Corrupt && v.Metadata.sameVersion(latest.Metadata) {
+			return nil, Metadata{}, fmt.Errorf("[%s] get (%s): replica (%s) holds a corrupt copy of version (%s): %w", s.Transport.Addr(), key, v.Node, latest.Metadata.VersionID, ErrReplicasDisagree)
+		}
+	}
+
+	if holders[0] != s.ID {
+		fmt.Printf("[%s] local copy of (%s) is missing or stale, fetching from network...\n", s.Transport.Addr(), key)
+
+		err := s.fetchFrom(s.ID, hashKey(key), latest.Metadata.VersionID, s.peersByNodeID(holders), func(r io.Reader, size int64, meta Metadata) (int64, error) {
+			return s.store.WriteDecrypt(s.EncKey, s.ID, key, r, meta)
+		})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	_, r, meta, err := s.store.ReadWithMetadata(s.ID, key)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	for _, v := range versions {
+		meta.Siblings = append(meta.Siblings, v.Metadata.Siblings...)
+	}
+	slices.Sort(meta.Siblings)
+	meta.Siblings = slices.DeleteFunc(slices.Compact(meta.Siblings), func(id string) bool { return id == meta.VersionID })
+
+	return r, meta, nil
+}
+
+// readVersions 向一组对端询问文件的元数据，返回最先到达的 need 个响应，其中包括没有该文件的对端的响应
+func (s *FileServer) readVersions(key string, peers []p2p.Peer, need int) ([]MessageGetFileResponse, error) {
+	if need <= 0 {
+		return nil, nil
+	}
+
+	req := s.addPendingRequest(len(peers))
+	defer s.removePendingRequest(req)
+
+	msg := Message{
+		Payload: MessageGetFile{
+			ID:        s.ID,
+			Key:       hashKey(key),
+			RequestID: req.id,
+			SizeOnly:  true,
+		},
+	}
+
+	if err := s.multicast(peers, &msg); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	var versions []MessageGetFileResponse
+	for len(versions) < need {
+		select {
+		case v := <-req.respCh:
+			versions = append(versions, v.(MessageGetFileResponse))
+		case <-timer.C:
+			return nil, fmt.Errorf("[%s] timed out waiting for versions of (%s): %d of %d replicas responded: %w", s.Transport.Addr(), key, len(versions), need, ErrQuorumNotReached)
+		case <-s.quitCh:
+			return nil, fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+		}
+	}
+
+	return versions, nil
+}
+
+// peersByNodeID 返回一组节点 ID 中已经连接的对端
+func (s *FileServer) peersByNodeID(ids []string) []p2p.Peer {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	var peers []p2p.Peer
+	for addr, nodeID := range s.nodeIDs {
+		if peer, ok := s.peers[addr]; ok && want[nodeID] {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuorumWrite(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30971", withNodes("127.0.0.1:30972"))
+	b := makeTestServer(t, "127.0.0.1:30972")
+	a.WriteQuorum = 2
+
+	startCluster(t, b, a)
+
+	// Store 返回时 b 已经确认写入了副本
+	key := "quorum.txt"
+	assert.Nil(t, a.Store(key, strings.NewReader("acknowledged")))
+	assert.True(t, b.store.Has(a.ID, hashKey(key)))
+
+	// 只有两个节点，无法得到三个副本的确认
+	a.WriteQuorum = 3
+	err := a.Store("unreachable.txt", strings.NewReader("data"))
+	assert.True(t, errors.Is(err, ErrQuorumNotReached))
+
+	// 副本上已经有更新的版本时，旧的写入得不到确认
+	a.WriteQuorum = 2
+	stale := "stale.txt"
+	newer := Metadata{CreatedAt: time.Now().Add(time.Hour)}
+	_, err = b.store.WriteFull(a.ID, hashKey(stale), stale, strings.NewReader("newer"), 5, newer)
+	assert.Nil(t, err)
+
+	err = a.Store(stale, strings.NewReader("older"))
+	assert.True(t, errors.Is(err, ErrQuorumNotReached))
+}
+
+func TestQuorumRead(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30973", withNodes("127.0.0.1:30974"))
+	b := makeTestServer(t, "127.0.0.1:30974")
+	a.WriteQuorum = 2
+
+	startCluster(t, b, a)
+
+	key := "profile.json"
+	hk := hashKey(key)
+	assert.Nil(t, a.Store(key, strings.NewReader("v1")))
+
+	// b 上有一个比 a 本地更新的版本
+	var enc bytes.Buffer
+	_, err := copyEncrypt(a.EncKey, strings.NewReader("v2"), &enc)
+	assert.Nil(t, err)
+	sum := sha256.Sum256([]byte("v2"))
+	newer := Metadata{Checksum: hex.EncodeToString(sum[:]), CreatedAt: time.Now().Add(time.Second)}
+	_, err = b.store.WriteFull(a.ID, hk, key, bytes.NewReader(enc.Bytes()), int64(enc.Len()), newer)
+	assert.Nil(t, err)
+
+	get := func() string {
+		r, _, err := a.Get(key)
+		assert.Nil(t, err)
+		if err != nil {
+			return ""
+		}
+		data, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		return string(data)
+	}
+
+	// 只读取一个副本时直接返回本地的旧版本
+	assert.Equal(t, "v1", get())
+
+	a.ReadQuorum = 2
+	assert.Equal(t, "v2", get())
+
+	// 一个副本保存的数据损坏时，同一个版本的内容不一致，返回错误
+	corruptBlob(t, b.store, a.ID, hk)
+	_, _, err = a.Get(key)
+	assert.True(t, errors.Is(err, ErrReplicasDisagree))
+
+	// 本地的数据损坏时同样返回错误
+	_, err = b.store.WriteFull(a.ID, hk, key, bytes.NewReader(enc.Bytes()), int64(enc.Len()), newer)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", get())
+	corruptBlob(t, a.store, a.ID, key)
+	_, _, err = a.Get(key)
+	assert.True(t, errors.Is(err, ErrReplicasDisagree))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// defaultVirtualNodes 是每个节点在哈希环上默认拥有的虚拟节点数量
+const defaultVirtualNodes = 64
+
+// HashRing 是一个一致性哈希环，每个节点通过多个虚拟节点分布在环上，
+// 一个 key 由顺时针方向遇到的前 N 个不同节点负责存储
+type HashRing struct {
+	mu sync.RWMutex
+
+	virtualNodes int
+	hashes       []uint32          // 排好序的虚拟节点哈希值
+	owners       map[uint32]string // 虚拟节点哈希值 -> 节点 ID
+	nodes        map[string]struct{}
+}
+
+// NewHashRing 创建一个新的哈希环
+func NewHashRing(virtualNodes int) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	return &HashRing{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint32]string),
+		nodes:        make(map[string]struct{}),
+	}
+}
+
+// Add 将一个节点加入哈希环，重复加入不会有任何效果
+func (r *HashRing) Add(nodeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[nodeID]; ok {
+		return
+	}
+	r.nodes[nodeID] = struct{}{}
+
+	for i := range r.virtualNodes {
+		h := ringHash(fmt.Sprintf("%s#%d", nodeID, i))
+		if _, ok := r.owners[h]; ok {
+			// 极少见的哈希碰撞，跳过这个虚拟节点
+			continue
+		}
+		r.owners[h] = nodeID
+		r.hashes = append(r.hashes, h)
+	}
+
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Remove 将一个节点从哈希环中移除
+func (r *HashRing) Remove(nodeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[nodeID]; !ok {
+		return
+	}
+	delete(r.nodes, nodeID)
+
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.owners[h] == nodeID {
+			delete(r.owners, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+}
+
+// Len 返回哈希环上节点的数量
+func (r *HashRing) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.nodes)
+}
+
+// Owners 返回负责存储 key 的前 n 个不同节点，节点数量不足 n 时返回所有节点
+func (r *HashRing) Owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	owners := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; len(owners) < n; i++ {
+		nodeID := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if _, ok := seen[nodeID]; ok {
+			continue
+		}
+		seen[nodeID] = struct{}{}
+		owners = append(owners, nodeID)
+	}
+
+	return owners
+}
+
+// ringHash 计算一个字符串在哈希环上的位置
+func ringHash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRingOwners(t *testing.T) {
+	ring := NewHashRing(defaultVirtualNodes)
+	for i := range 5 {
+		ring.Add(fmt.Sprintf("node_%d", i))
+	}
+
+	owners := ring.Owners(hashKey("picture.png"), 3)
+	assert.Len(t, owners, 3)
+
+	seen := make(map[string]bool)
+	for _, owner := range owners {
+		assert.False(t, seen[owner], "owners must be distinct")
+		seen[owner] = true
+	}
+
+	// 同样的 key 每次都应该得到同样的结果
+	assert.Equal(t, owners, ring.Owners(hashKey("picture.png"), 3))
+
+	// 副本数量大于节点数量时返回所有节点
+	assert.Len(t, ring.Owners(hashKey("picture.png"), 10), 5)
+}
+
+func TestHashRingAddMovesFewKeys(t *testing.T) {
+	ring := NewHashRing(defaultVirtualNodes)
+	for i := range 4 {
+		ring.Add(fmt.Sprintf("node_%d", i))
+	}
+
+	before := make(map[string]string)
+	for i := range 1000 {
+		key := hashKey(fmt.Sprintf("key_%d", i))
+		before[key] = ring.Owners(key, 1)[0]
+	}
+
+	ring.Add("node_4")
+
+	moved := 0
+	for key, owner := range before {
+		newOwner := ring.Owners(key, 1)[0]
+		if newOwner != owner {
+			assert.Equal(t, "node_4", newOwner, "keys may only move to the new node")
+			moved++
+		}
+	}
+
+	// 理想情况下大约有 1/5 的 key 会迁移到新节点
+	assert.Greater(t, moved, 100)
+	assert.Less(t, moved, 350)
+
+	ring.Remove("node_4")
+	for key, owner := range before {
+		assert.Equal(t, owner, ring.Owners(key, 1)[0])
+	}
+}
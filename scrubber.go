@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultScrubRate 是完整性检查默认每秒最多读取的字节数
+const defaultScrubRate = 16 << 20
+
+// ScrubStats 是完整性检查的统计信息
+type ScrubStats struct {
+	// Running 表示当前是否正在进行一轮检查
+	Running bool
+	// Passes 是已经完成的检查轮数，LastPass 是上一轮完成的时间
+	Passes   int
+	LastPass time.Time
+	// PassScanned 和 PassTotal 是当前这一轮已经检查的文件数量和需要检查的文件总数
+	PassScanned int
+	PassTotal   int
+	// Scanned 和 BytesScanned 是累计检查过的文件数量和字节数
+	Scanned      int64
+	BytesScanned int64
+	// Corrupt 是发现的损坏版本数量，Repaired 是其中从对端重新获取成功的数量
+	Corrupt  int64
+	Repaired int64
+	// Errors 是检查过程中遇到的其他错误的数量
+	Errors int64
+}
+
+// scrubber 记录完整性检查的进度
+type scrubber struct {
+	mu    sync.Mutex
+	stats ScrubStats
+}
+
+func (sc *scrubber) update(fn func(stats *ScrubStats)) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	fn(&sc.stats)
+}
+
+// ScrubStats 返回后台完整性检查的统计信息
+func (s *FileServer) ScrubStats() ScrubStats {
+	s.scrubber.mu.Lock()
+	defer s.scrubber.mu.Unlock()
+
+	return s.scrubber.stats
+}
+
+// scrubLoop 每隔 ScrubInterval 检查一遍本地存储的所有文件，直到文件服务器停止
+func (s *FileServer) scrubLoop() {
+	ticker := time.NewTicker(s.ScrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.scrub()
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// scrub 重新计算本地存储的每个文件保留的所有版本的 SHA-256，损坏的版本被隔离，然后从对端重新获取
+func (s *FileServer) scrub() {
+	keys, err := s.store.Keys()
+	if err != nil {
+		slog.Error("scrubber failed to list keys", "error", err)
+		s.scrubber.update(func(stats *ScrubStats) { stats.Errors++ })
+		return
+	}
+
+	s.scrubber.update(func(stats *ScrubStats) {
+		stats.Running = true
+		stats.PassScanned, stats.PassTotal = 0, len(keys)
+	})
+	defer s.scrubber.update(func(stats *ScrubStats) { stats.Running = false })
+
+	p := &pacer{rate: s.ScrubRate, start: time.Now(), quitCh: s.quitCh}
+
+	for _, key := range keys {
+		select {
+		case <-s.quitCh:
+			return
+		default:
+		}
+
+		versions, err := s.store.Versions(key.ID, key.Key)
+		if errors.Is(err, os.ErrNotExist) {
+			// 检查之前已经被删除
+			continue
+		}
+		if err != nil {
+			slog.Error("scrubber failed to list versions", "id", key.ID, "key", key.Key, "error", err)
+			s.scrubber.update(func(stats *ScrubStats) { stats.Errors++ })
+			continue
+		}
+
+		for _, v := range versions {
+			s.scrubVersion(key, v.VersionID, p)
+		}
+		s.scrubber.update(func(stats *ScrubStats) {
+			stats.PassScanned++
+			stats.Scanned++
+		})
+	}
+
+	s.scrubber.update(func(stats *ScrubStats) {
+		stats.Passes++
+		stats.LastPass = time.Now()
+	})
+}
+
+// scrubVersion 检查文件的一个版本，损坏的版本被隔离，然后从对端重新获取
+func (s *FileServer) scrubVersion(key StoredKey, versionID string, p *pacer) {
+	n, err := s.store.VerifyVersion(key.ID, key.Key, versionID, p)
+	s.scrubber.update(func(stats *ScrubStats) { stats.BytesScanned += n })
+
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrChecksumMismatch):
+		slog.Warn("scrubber found corrupt version", "id", key.ID, "key", key.Key, "version", versionID, "error", err)
+		s.scrubber.update(func(stats *ScrubStats) { stats.Corrupt++ })
+
+		if err := s.repair(key, versionID); err != nil {
+			slog.Error("scrubber failed to repair version", "id", key.ID, "key", key.Key, "version", versionID, "error", err)
+			return
+		}
+		s.scrubber.update(func(stats *ScrubStats) { stats.Repaired++ })
+	case errors.Is(err, os.ErrNotExist):
+		// 检查之前已经被删除，或者超出了保留的版本数量
+	default:
+		slog.Error("scrubber failed to verify version", "id", key.ID, "key", key.Key, "version", versionID, "error", err)
+		s.scrubber.update(func(stats *ScrubStats) { stats.Errors++ })
+	}
+}
+
+// repair 隔离损坏的版本，再从对端重新获取这个版本的一份完好的副本，其他版本不受影响
+func (s *FileServer) repair(key StoredKey, versionID string) error {
+	name, err := s.store.Quarantine(key.ID, key.Key, versionID)
+	if err != nil {
+		return err
+	}
+
+	// 本节点自己的文件保存的是明文，对端保存的是用本节点的密钥加密后的副本
+	if key.ID == s.ID {
+		return s.fetch(name, versionID)
+	}
+
+	// 其他节点的副本保存的是密文，原样从持有同一副本的对端复制过来
+	peers := s.connectedPeers()
+	if len(peers) == 0 {
+		return ErrFileNotFound
+	}
+
+	return s.fetchFrom(key.ID, key.Key, versionID, peers, func(r io.Reader, size int64, meta Metadata) (int64, error) {
+		return s.store.WriteFull(key.ID, key.Key, name, r, size, meta)
+	})
+}
+
+// pacer 是一个丢弃写入数据的 writer，写入的速度超过 rate 字节每秒时会等待
+type pacer struct {
+	rate   int64
+	start  time.Time
+	n      int64
+	quitCh chan struct{}
+}
+
+func (p *pacer) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	if p.rate <= 0 {
+		return len(b), nil
+	}
+
+	ahead := time.Duration(float64(p.n)/float64(p.rate)*float64(time.Second)) - time.Since(p.start)
+	if ahead <= 0 {
+		return len(b), nil
+	}
+
+	select {
+	case <-time.After(ahead):
+	case <-p.quitCh:
+	}
+
+	return len(b), nil
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"bytes"
 	"distributed-file-store/p2p"
-	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
@@ -16,69 +19,269 @@ import (
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
+	gob.Register(MessageHello{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageDeleteAck{})
+	gob.Register(MessageListKeys{})
+	gob.Register(MessageListKeysResponse{})
+	gob.Register(MessageMerkleNodes{})
+	gob.Register(MessageMerkleNodesResponse{})
+	gob.Register(MessageMerkleLeaves{})
+	gob.Register(MessageMerkleLeavesResponse{})
+	gob.Register(MessageStoreHint{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessageListVersions{})
+	gob.Register(MessageListVersionsResponse{})
 }
 
+// ErrFileNotFound 表示本地和网络上的对端都没有请求的文件
+var ErrFileNotFound = errors.New("file not found")
+
+const (
+	// defaultRequestTimeout 是等待对端响应的默认超时时间
+	defaultRequestTimeout = 5 * time.Second
+	// defaultReplicationFactor 是每个文件默认保存的副本数量
+	defaultReplicationFactor = 3
+	// defaultListLimit 是 List 没有指定数量时每页返回的最大 key 数量
+	defaultListLimit = 1000
+	// defaultHandshakeTimeout 是和对端协商协议版本和握手时的默认超时时间
+	defaultHandshakeTimeout = 5 * time.Second
+)
+
 type FileServerOpts struct {
-	ID                string
+	// ID 是节点 ID，为空时由 Identity 的公钥决定
+	ID string
+	// Identity 是节点的 Ed25519 身份，需要和传输层的认证握手使用同一个身份，为空时生成一个新的身份
+	Identity          *p2p.Identity
 	EncKey            []byte
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string
+	// Backend 是保存文件的存储介质，为空时使用 StorageRoot 目录下的本地文件系统
+	Backend        Backend
+	Transport      p2p.Transport
+	BootstrapNodes []string
+	// RequestTimeout 是向对端发出请求后等待响应的最长时间
+	RequestTimeout time.Duration
+	// HandshakeTimeout 是和对端协商协议版本和握手时等待对端的最长时间，
+	// Transport 实现了 p2p.HandshakeConfigurer 时覆盖它自己的设置
+	HandshakeTimeout time.Duration
+	// ReplicationFactor 是每个文件保存的副本数量，副本位置由一致性哈希环决定
+	ReplicationFactor int
+	// VirtualNodes 是每个节点在哈希环上的虚拟节点数量
+	VirtualNodes int
+	// ReconnectBackoff 是连接失败后第一次重试前的等待时间，之后每次失败翻倍
+	ReconnectBackoff time.Duration
+	// MaxReconnectBackoff 是重试连接前等待时间的上限
+	MaxReconnectBackoff time.Duration
+	// HTTPAddr 不为空时，在该地址上启动 HTTP 网关
+	HTTPAddr string
+	// ScrubInterval 是两轮后台完整性检查之间的间隔，为 0 时不在后台检查
+	ScrubInterval time.Duration
+	// ScrubRate 是完整性检查每秒最多读取的字节数，小于 0 时不限制
+	ScrubRate int64
+	// AntiEntropyInterval 是两轮反熵同步之间的间隔，小于 0 时不同步
+	AntiEntropyInterval time.Duration
+	// HintTTL 是替离线节点暂存的副本保存的最长时间，从文件写入时开始计算
+	HintTTL time.Duration
+	// WriteQuorum 是 Store 返回之前需要确认写入成功的副本数量，本地的写入算作一个，默认为 1
+	WriteQuorum int
+	// ReadQuorum 是 Get 返回之前需要比较版本的副本数量，本地的文件算作一个，默认为 1
+	ReadQuorum int
+	// MaxVersions 是每个文件最多保留的版本数量，包括当前的版本
+	MaxVersions int
+	// ConflictResolver 用于解决并发写入同一个文件产生的冲突，为空时保留所有并发的版本，由 Get 返回
+	ConflictResolver ConflictResolver
 }
 
 // FileServer 是一个简单的文件服务器，它可以接收来自网络上的对端的文件请求
 type FileServer struct {
 	FileServerOpts
 
+	// peerLock 保护 peers 和 nodeIDs
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
+	// nodeIDs 保存对端地址到对端节点 ID 的映射，对端发来 MessageHello 后才会有记录
+	nodeIDs map[string]string
+
+	ring *HashRing
+	// clock 为本节点写入的文件生成版本 ID
+	clock *HLC
 
-	store  *Store
-	quitCh chan struct{}
+	// pendingLock 保护 pending，pending 保存正在等待对端响应的请求
+	pendingLock sync.Mutex
+	pending     map[string]*pendingRequest
+
+	// streamLock 保护 streams 和 writes
+	streamLock sync.Mutex
+	// streams 保存对端打开、还没有被消息认领的流
+	streams map[streamKey]chan p2p.Stream
+	// writes 保存每个文件正在进行的写入，读取和删除文件之前要等它们结束
+	writes map[fileKey][]<-chan struct{}
+
+	// treeLock 保护 trees，trees 保存对端正在进行的同步使用的本地哈希树
+	treeLock sync.Mutex
+	trees    map[[2]string]*sessionTree
+
+	store      *Store
+	scrubber   scrubber
+	httpServer *http.Server
+	quitCh     chan struct{}
 }
 
-// NewFileServer 创建一个新的文件服务器
-func NewFileServer(opts FileServerOpts) *FileServer {
+// NewFileServer 创建一个新的文件服务器，没有指定 Identity 时生成身份失败会返回错误
+func NewFileServer(opts FileServerOpts) (*FileServer, error) {
+	if opts.Identity == nil {
+		identity, err := p2p.NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		opts.Identity = identity
+	}
+
+	if len(opts.ID) == 0 {
+		opts.ID = opts.Identity.ID()
+	}
+
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	if t, ok := opts.Transport.(p2p.HandshakeConfigurer); ok {
+		t.SetHandshakeTimeout(opts.HandshakeTimeout)
+	}
+
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+
+	if opts.ReconnectBackoff == 0 {
+		opts.ReconnectBackoff = defaultReconnectBackoff
+	}
+
+	if opts.MaxReconnectBackoff == 0 {
+		opts.MaxReconnectBackoff = defaultMaxReconnectBackoff
+	}
+
+	if opts.ScrubRate == 0 {
+		opts.ScrubRate = defaultScrubRate
+	}
+
+	if opts.AntiEntropyInterval == 0 {
+		opts.AntiEntropyInterval = defaultAntiEntropyInterval
+	}
+
+	if opts.HintTTL == 0 {
+		opts.HintTTL = defaultHintTTL
+	}
+
+	if opts.WriteQuorum == 0 {
+		opts.WriteQuorum = 1
+	}
+
+	if opts.ReadQuorum == 0 {
+		opts.ReadQuorum = 1
+	}
+
+	if opts.MaxVersions == 0 {
+		opts.MaxVersions = defaultMaxVersions
+	}
+
 	storeOpts := StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Backend:           opts.Backend,
+		MaxVersions:       opts.MaxVersions,
+		Resolver:          opts.ConflictResolver,
 	}
 
-	if len(opts.ID) == 0 {
-		opts.ID = generateID()
-	}
+	ring := NewHashRing(opts.VirtualNodes)
+	ring.Add(opts.ID)
 
 	return &FileServer{
 		FileServerOpts: opts,
 		store:          NewStore(storeOpts),
 		quitCh:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
-	}
+		nodeIDs:        make(map[string]string),
+		ring:           ring,
+		clock:          NewHLC(opts.ID),
+		pending:        make(map[string]*pendingRequest),
+		streams:        make(map[streamKey]chan p2p.Stream),
+		writes:         make(map[fileKey][]<-chan struct{}),
+		trees:          make(map[[2]string]*sessionTree),
+	}, nil
 }
 
 // Start 启动文件服务器
 func (s *FileServer) Start() error {
 	fmt.Printf("[%s] starting fileserver...\n", s.Transport.Addr())
+
+	if err := s.store.RemoveTempFiles(); err != nil {
+		return err
+	}
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
 
+	if len(s.HTTPAddr) > 0 {
+		s.httpServer = &http.Server{
+			Addr:    s.HTTPAddr,
+			Handler: NewGateway(s),
+		}
+
+		go func() {
+			slog.Info("HTTP gateway listening", "addr", s.HTTPAddr)
+			if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP gateway error", "error", err)
+			}
+		}()
+	}
+
+	if s.ScrubInterval > 0 {
+		go s.scrubLoop()
+	}
+
+	if s.AntiEntropyInterval > 0 {
+		go s.antiEntropyLoop()
+	}
+
+	go s.hintLoop()
+
 	s.bootstrapNetwork()
 	s.loop()
 	return nil
 }
 
-// broadcast 广播消息给所有的对端
-func (s *FileServer) broadcast(msg *Message) error {
+// send 将消息编码后发送给指定的对端
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	frame, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	return peer.Send(frame)
+}
+
+// encodeMessage 将消息编码为一个消息帧
+func encodeMessage(msg *Message) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+	return p2p.EncodeMessage(buf.Bytes()), nil
+}
+
+// multicast 将消息发送给指定的一组对端
+func (s *FileServer) multicast(peers []p2p.Peer, msg *Message) error {
+	for _, peer := range peers {
+		if err := s.send(peer, msg); err != nil {
 			return err
 		}
 	}
@@ -86,6 +289,49 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
+// peer 返回指定地址的对端，对端已经断开时返回 false
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// connectedPeers 返回所有已连接的对端
+func (s *FileServer) connectedPeers() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// replicaPeers 根据哈希环将已连接的对端分成负责存储 key 的副本节点和其他节点
+func (s *FileServer) replicaPeers(key string) (owners []p2p.Peer, others []p2p.Peer) {
+	isOwner := make(map[string]bool)
+	for _, nodeID := range s.ring.Owners(hashKey(key), s.ReplicationFactor) {
+		isOwner[nodeID] = true
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for addr, peer := range s.peers {
+		if nodeID, ok := s.nodeIDs[addr]; ok && isOwner[nodeID] {
+			owners = append(owners, peer)
+		} else {
+			others = append(others, peer)
+		}
+	}
+
+	return owners, others
+}
+
 type Message struct {
 	Payload any
 }
@@ -94,114 +340,692 @@ type MessageStoreFile struct {
 	ID   string
 	Key  string
 	Size int64
+	// Name 是文件原始的 key，副本将它记录在索引中，以便列出文件
+	Name     string
+	Metadata Metadata
+	// RequestID 不为空时，对端在写入完成后回复 MessageStoreAck
+	RequestID string
+	// StreamID 是发送文件内容的流，流在消息之前打开
+	StreamID uint64
+}
+
+// MessageHello 在连接建立后发送给对端，告知本节点的 ID
+type MessageHello struct {
+	ID string
 }
 
 type MessageGetFile struct {
-	ID  string
-	Key string
+	ID        string
+	Key       string
+	RequestID string
+	// SizeOnly 为 true 时对端只返回文件的大小，不发送文件内容
+	SizeOnly bool
+	// Version 不为空时请求文件的这个版本，否则请求当前的版本
+	Version string
+}
+
+// MessageGetFileResponse 是对 MessageGetFile 的响应
+type MessageGetFileResponse struct {
+	RequestID string
+	Found     bool
+	Size      int64
+	Metadata  Metadata
+	// Node 是响应的节点的 ID
+	Node string
+	// StreamID 不为 0 时，长度为 Size 的文件在这个流中发送
+	StreamID uint64
+	// Corrupt 表示响应的节点上保存的数据和写入时记录的 SHA-256 不一致，只在 SizeOnly 的响应中填写
+	Corrupt bool
+}
+
+// MessageDeleteFile 通知副本节点删除文件并留下墓碑
+type MessageDeleteFile struct {
+	ID        string
+	Key       string
+	RequestID string
+	// DeletedAt 是删除时的混合逻辑时钟时间戳，和文件的版本 ID 比较先后
+	DeletedAt Timestamp
+}
+
+// MessageDeleteAck 是对 MessageDeleteFile 的确认，Err 为空表示删除成功
+type MessageDeleteAck struct {
+	RequestID string
+	Err       string
+}
+
+// MessageListKeys 请求对端列出 ID 下原始 key 以 Prefix 开头、排在 After 之后的至多 Limit 个文件
+type MessageListKeys struct {
+	ID        string
+	Prefix    string
+	After     string
+	Limit     int
+	RequestID string
+}
+
+// MessageListKeysResponse 是对 MessageListKeys 的响应，More 为 true 表示还有更多的 key
+type MessageListKeysResponse struct {
+	RequestID string
+	Keys      []KeyInfo
+	More      bool
+	Err       string
+}
+
+// fetchedStream 是一个有文件的对端发来的流
+type fetchedStream struct {
+	from   string
+	stream p2p.Stream
+	size   int64
+	meta   Metadata
 }
 
-// Get 从本地磁盘获取文件
-func (s *FileServer) Get(key string) (io.Reader, error) {
+// pendingRequest 是一个发给一组对端、正在等待响应的请求
+type pendingRequest struct {
+	id string
+	// respCh 接收对端的响应消息，容量等于请求发送的对端数量
+	respCh chan any
+	// streamCh 接收第一个有该文件的对端的流
+	streamCh chan fetchedStream
+	// doneCh 在请求结束后关闭，之后到达的流都会被重置
+	doneCh chan struct{}
+	// claimed 表示已经有对端被选中发送文件，只在 loop 中访问
+	claimed bool
+}
+
+// Get 获取文件和它的元数据，本地没有时从网络上的对端获取
+// 指定 version 时获取文件的这个版本，否则获取当前的版本。
+// ReadQuorum 大于 1 时先比较多个副本的版本，返回最新的一个
+func (s *FileServer) Get(key string, version ...string) (io.Reader, Metadata, error) {
+	if _, deleted := s.store.Tombstone(s.ID, key); deleted {
+		return nil, Metadata{}, fmt.Errorf("[%s] file (%s) has been deleted: %w", s.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	if len(version) > 0 && len(version[0]) > 0 {
+		return s.getVersion(key, version[0])
+	}
+
+	if s.ReadQuorum > 1 {
+		return s.quorumGet(key)
+	}
+
 	if s.store.Has(s.ID, key) {
 		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key)
-		return r, err
+		_, r, meta, err := s.store.ReadWithMetadata(s.ID, key)
+		return r, meta, err
 	}
 
 	fmt.Printf("[%s] dont have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
 
+	if err := s.fetch(key, ""); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	_, r, meta, err := s.store.ReadWithMetadata(s.ID, key)
+	return r, meta, err
+}
+
+// fetch 从网络上获取文件的版本 version 并写入本地磁盘，version 为空时获取当前的版本
+// 先询问负责存储该文件的副本节点，再询问其他节点
+func (s *FileServer) fetch(key string, version string) error {
+	owners, others := s.replicaPeers(key)
+	if len(owners)+len(others) == 0 {
+		return fmt.Errorf("[%s] file (%s) not available locally and no peers connected: %w", s.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	var err error
+	for _, peers := range [][]p2p.Peer{owners, others} {
+		if len(peers) == 0 {
+			continue
+		}
+		err = s.fetchFrom(s.ID, hashKey(key), version, peers, func(r io.Reader, size int64, meta Metadata) (int64, error) {
+			return s.store.WriteDecrypt(s.EncKey, s.ID, key, r, meta)
+		})
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// fetchFrom 向一组对端请求它们保存的 (id, key) 的版本 version，version 为空时请求当前的版本，
+// 将第一个有该文件的对端发来的数据交给 write 写入本地磁盘
+func (s *FileServer) fetchFrom(id string, key string, version string, peers []p2p.Peer, write func(r io.Reader, size int64, meta Metadata) (int64, error)) error {
+	numPeers := len(peers)
+	req := s.addPendingRequest(numPeers)
+	defer s.removePendingRequest(req)
+
 	msg := Message{
 		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: hashKey(key),
+			ID:        id,
+			Key:       key,
+			RequestID: req.id,
+			Version:   version,
 		},
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	if err := s.multicast(peers, &msg); err != nil {
+		return err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
 
-	for _, peer := range s.peers {
-		// 首先读取文件大小，这样就可以限制从连接读取的字节数，这样它就不会一直挂起
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+	for waiting := numPeers; waiting > 0; {
+		select {
+		case <-req.respCh:
+			waiting--
+		case st := <-req.streamCh:
+			n, err := write(io.LimitReader(st.stream, st.size), st.size, st.meta)
+			if err != nil {
+				st.stream.Reset()
+				return err
+			}
+			st.stream.Close()
+
+			fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, st.from)
+			return nil
+		case <-timer.C:
+			return fmt.Errorf("[%s] timed out waiting for file (%s) from peers", s.Transport.Addr(), key)
+		case <-s.quitCh:
+			return fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+		}
+	}
+
+	return fmt.Errorf("[%s] file (%s) not found on any of %d peers: %w", s.Transport.Addr(), key, numPeers, ErrFileNotFound)
+}
+
+// Stat 返回文件的大小和元数据，本地没有时询问网络上的对端，不会传输文件内容
+func (s *FileServer) Stat(key string) (int64, Metadata, error) {
+	if _, deleted := s.store.Tombstone(s.ID, key); deleted {
+		return 0, Metadata{}, fmt.Errorf("[%s] file (%s) has been deleted: %w", s.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	if size, err := s.store.Stat(s.ID, key); err == nil {
+		meta, err := s.store.Metadata(s.ID, key)
+		return size, meta, err
+	}
+
+	owners, others := s.replicaPeers(key)
+	if len(owners)+len(others) == 0 {
+		return 0, Metadata{}, fmt.Errorf("[%s] file (%s) not available locally and no peers connected: %w", s.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	var err error
+	for _, peers := range [][]p2p.Peer{owners, others} {
+		if len(peers) == 0 {
+			continue
+		}
+
+		var resp MessageGetFileResponse
+		if resp, err = s.statFrom(key, peers); err == nil {
+			// 对端保存的是加密后的文件，返回明文的大小
+			size, err := decryptedSize(resp.Size)
+			return size, resp.Metadata, err
+		}
+	}
+
+	return 0, Metadata{}, err
+}
+
+// statFrom 向一组对端询问文件的大小和元数据，返回第一个有该文件的对端的响应
+func (s *FileServer) statFrom(key string, peers []p2p.Peer) (MessageGetFileResponse, error) {
+	req := s.addPendingRequest(len(peers))
+	defer s.removePendingRequest(req)
+
+	msg := Message{
+		Payload: MessageGetFile{
+			ID:        s.ID,
+			Key:       hashKey(key),
+			RequestID: req.id,
+			SizeOnly:  true,
+		},
+	}
+
+	if err := s.multicast(peers, &msg); err != nil {
+		return MessageGetFileResponse{}, err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	for waiting := len(peers); waiting > 0; waiting-- {
+		select {
+		case resp := <-req.respCh:
+			if resp := resp.(MessageGetFileResponse); resp.Found {
+				return resp, nil
+			}
+		case <-timer.C:
+			return MessageGetFileResponse{}, fmt.Errorf("[%s] timed out waiting for size of (%s) from peers", s.Transport.Addr(), key)
+		case <-s.quitCh:
+			return MessageGetFileResponse{}, fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+		}
+	}
+
+	return MessageGetFileResponse{}, fmt.Errorf("[%s] file (%s) not found on any of %d peers: %w", s.Transport.Addr(), key, len(peers), ErrFileNotFound)
+}
+
+func (s *FileServer) addPendingRequest(numPeers int) *pendingRequest {
+	req := &pendingRequest{
+		id:       generateID(),
+		respCh:   make(chan any, numPeers),
+		streamCh: make(chan fetchedStream),
+		doneCh:   make(chan struct{}),
+	}
+
+	s.pendingLock.Lock()
+	s.pending[req.id] = req
+	s.pendingLock.Unlock()
 
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+	return req
+}
+
+func (s *FileServer) removePendingRequest(req *pendingRequest) {
+	s.pendingLock.Lock()
+	delete(s.pending, req.id)
+	s.pendingLock.Unlock()
+
+	close(req.doneCh)
+}
+
+// deliver 将响应交给等待中的请求，超出预期数量的响应会被丢弃，避免阻塞 loop
+func (r *pendingRequest) deliver(resp any) {
+	select {
+	case r.respCh <- resp:
+	default:
+	}
+}
+
+// pendingRequest 返回还在等待响应的请求，请求已经结束时返回 false
+func (s *FileServer) pendingRequest(id string) (*pendingRequest, bool) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	req, ok := s.pending[id]
+	return req, ok
+}
+
+// Delete 从整个集群中删除文件：删除本地文件并留下墓碑，
+// 再通知负责该文件的副本节点删除，并等待它们的确认
+func (s *FileServer) Delete(key string) error {
+	// 和版本 ID 使用同一个时钟，即使物理时钟有偏差，删除也排在本节点之前见过的所有版本之后
+	deletedAt := s.clock.Now()
+
+	if err := s.store.WriteTombstone(s.ID, key, deletedAt); err != nil {
+		return err
+	}
+
+	owners, _ := s.replicaPeers(key)
+	if len(owners) == 0 {
+		return nil
+	}
+
+	req := s.addPendingRequest(len(owners))
+	defer s.removePendingRequest(req)
+
+	msg := Message{
+		Payload: MessageDeleteFile{
+			ID:        s.ID,
+			Key:       hashKey(key),
+			RequestID: req.id,
+			DeletedAt: deletedAt,
+		},
+	}
+
+	if err := s.multicast(owners, &msg); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	var errs []error
+	for acked := 0; acked < len(owners); acked++ {
+		select {
+		case resp := <-req.respCh:
+			if ack := resp.(MessageDeleteAck); ack.Err != "" {
+				errs = append(errs, errors.New(ack.Err))
+			}
+		case <-timer.C:
+			return fmt.Errorf("[%s] timed out waiting for delete of (%s): %d of %d replicas acknowledged", s.Transport.Addr(), key, acked, len(owners))
+		case <-s.quitCh:
+			return fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+		}
+	}
+
+	fmt.Printf("[%s] deleted (%s) from %d replicas\n", s.Transport.Addr(), key, len(owners)-len(errs))
+
+	return errors.Join(errs...)
+}
+
+// List 列出本节点存储在集群中的、key 以 prefix 开头的文件，合并本地和所有对端的索引
+// 结果按 key 排序，每次至多返回 limit 个，从 after 之后开始。
+// next 不为空时表示还有更多的 key，将它作为下一次调用的 after 即可获取下一页
+func (s *FileServer) List(prefix string, after string, limit int) (keys []KeyInfo, next string, err error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	local, err := s.store.List(s.ID, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// 每个来源都返回它排在 after 之后的前 limit 个 key，合并后的前 limit 个 key 一定都在其中
+	merged := make(map[string]KeyInfo)
+	isLocal := make(map[string]bool)
+	page, more := paginate(local, after, limit)
+	for _, info := range page {
+		merged[info.Key] = info
+		isLocal[info.Key] = true
+	}
+
+	if peers := s.connectedPeers(); len(peers) > 0 {
+		remote, remoteMore, err := s.listFrom(peers, prefix, after, limit)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
+		more = more || remoteMore
+
+		for _, info := range remote {
+			// 对端保存的是加密后的文件，返回明文的大小
+			if info.Size, err = decryptedSize(info.Size); err != nil {
+				continue
+			}
+			// 本地的记录优先，其次是最新的副本
+			if prev, ok := merged[info.Key]; ok && (isLocal[info.Key] || !prev.ModTime.Before(info.ModTime)) {
+				continue
+			}
+			merged[info.Key] = info
+		}
+	}
+
+	for key, info := range merged {
+		if _, deleted := s.store.Tombstone(s.ID, key); deleted {
+			delete(merged, key)
+			continue
+		}
+		keys = append(keys, info)
+	}
 
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)", s.Transport.Addr(), n, peer.RemoteAddr())
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
 
-		peer.CloseStream()
+	if len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+	if more && len(keys) > 0 {
+		next = keys[len(keys)-1].Key
+	}
+
+	return keys, next, nil
+}
+
+// listFrom 向一组对端请求本节点的文件列表，返回所有对端结果的并集
+func (s *FileServer) listFrom(peers []p2p.Peer, prefix string, after string, limit int) ([]KeyInfo, bool, error) {
+	req := s.addPendingRequest(len(peers))
+	defer s.removePendingRequest(req)
+
+	msg := Message{
+		Payload: MessageListKeys{
+			ID:        s.ID,
+			Prefix:    prefix,
+			After:     after,
+			Limit:     limit,
+			RequestID: req.id,
+		},
+	}
+
+	if err := s.multicast(peers, &msg); err != nil {
+		return nil, false, err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	var (
+		keys []KeyInfo
+		more bool
+		errs []error
+	)
+	for received := 0; received < len(peers); received++ {
+		select {
+		case v := <-req.respCh:
+			resp := v.(MessageListKeysResponse)
+			if resp.Err != "" {
+				errs = append(errs, errors.New(resp.Err))
+				continue
+			}
+			keys = append(keys, resp.Keys...)
+			more = more || resp.More
+		case <-timer.C:
+			return nil, false, fmt.Errorf("[%s] timed out listing (%s): %d of %d peers responded", s.Transport.Addr(), prefix, received, len(peers))
+		case <-s.quitCh:
+			return nil, false, fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+		}
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	return keys, more, errors.Join(errs...)
 }
 
-// Store 存储文件
+// Store 存储文件，之前的版本按照 MaxVersions 保留
 func (s *FileServer) Store(key string, r io.Reader) error {
-	// 1.将文件存到磁盘
-	// 2.将文件广播给其他节点
+	_, err := s.StoreWithMetadata(key, r, Metadata{})
+	return err
+}
 
-	fileBuffer := new(bytes.Buffer)
-	tee := io.TeeReader(r, fileBuffer)
+// StoreWithMetadata 存储文件和它的元数据，元数据和文件一起复制到副本节点，返回新版本的 ID
+// meta 中的 Checksum、CreatedAt、VersionID 和 Parents 由本节点在写入时填写，
+// Parents 是本地当前的版本和与它并发的版本，新的版本取代它们
+// 包括本地在内有 WriteQuorum 个副本确认写入磁盘之后才返回
+func (s *FileServer) StoreWithMetadata(key string, r io.Reader, meta Metadata) (string, error) {
+	// 1.将文件流式写入磁盘
+	// 2.从磁盘读回文件，加密后发送给哈希环上负责该文件的副本节点
+	// 整个过程只使用固定大小的缓冲区，内存占用与文件大小无关
+
+	ts := s.clock.Now()
+	meta.Checksum, meta.CreatedAt, meta.VersionID, meta.Parents = "", ts.Time(), ts.String(), nil
+	if cur, err := s.store.Metadata(s.ID, key); err == nil {
+		for _, id := range append([]string{cur.VersionID}, cur.Siblings...) {
+			if len(id) > 0 {
+				meta.Parents = append(meta.Parents, id)
+			}
+		}
+	}
 
-	size, err := s.store.Write(s.ID, key, tee)
+	size, err := s.store.WriteWithMetadata(s.ID, key, r, meta)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	log.Printf("written (%d bytes) to dist\n", size)
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16,
-		},
+	owners, _ := s.replicaPeers(key)
+
+	req := s.addPendingRequest(len(owners))
+	defer s.removePendingRequest(req)
+
+	if len(owners) > 0 {
+		err := s.sendEncrypted(key, meta.VersionID, owners, func(msg MessageStoreFile) any {
+			msg.RequestID = req.id
+			return msg
+		})
+		if err != nil {
+			return meta.VersionID, err
+		}
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	// 离线的副本节点由其他节点暂存一份，等它重新连接后再发送给它
+	if offline := s.offlineOwners(key); len(offline) > 0 {
+		if err := s.handoff(key, meta.VersionID, offline); err != nil {
+			return meta.VersionID, err
+		}
+	}
+
+	return meta.VersionID, s.awaitWriteQuorum(key, req, len(owners))
+}
+
+// replicate 从磁盘读回本节点的文件，加密后发送给一组对端
+func (s *FileServer) replicate(key string, owners []p2p.Peer) error {
+	return s.sendEncrypted(key, "", owners, func(msg MessageStoreFile) any { return msg })
+}
+
+// sendEncrypted 从磁盘读回本节点的文件的版本 versionID，在每个对端上打开一个流，将 newMsg 根据文件生成的消息发送给它们，
+// 再通过流发送加密后的文件。versionID 为空时发送当前的版本。被对端重置的流不算失败，对端会通过确认说明原因
+func (s *FileServer) sendEncrypted(key string, versionID string, peers []p2p.Peer, newMsg func(MessageStoreFile) any) error {
+	// 按版本打开，同一个 key 上并发的写入各自发送自己写入的版本，而不是当时的当前版本
+	size, fr, meta, err := s.store.ReadVersion(s.ID, key, versionID)
+	if err != nil {
 		return err
 	}
+	defer fr.Close()
 
-	time.Sleep(time.Millisecond * 5)
+	msg := MessageStoreFile{
+		ID:       s.ID,
+		Key:      hashKey(key),
+		Size:     encryptedSize(size),
+		Name:     key,
+		Metadata: meta,
+	}
 
-	peers := make([]io.Writer, 0, len(s.peers))
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	fw := &fanoutWriter{}
+	for _, peer := range peers {
+		st, err := peer.OpenStream()
+		if err != nil {
+			fw.errs = append(fw.errs, err)
+			continue
+		}
+
+		msg.StreamID = st.ID()
+		if err := s.send(peer, &Message{Payload: newMsg(msg)}); err != nil {
+			st.Reset()
+			fw.errs = append(fw.errs, err)
+			continue
+		}
+		fw.streams = append(fw.streams, st)
 	}
-	mw := io.MultiWriter(peers...) // 将数据写入多个 writer
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
+
+	n, err := copyEncrypt(s.EncKey, fr, fw)
 	if err != nil {
+		fw.reset()
 		return err
 	}
+	fw.close()
 
 	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
-	return nil
+	return fw.err()
+}
+
+// fanoutWriter 将数据写入一组流，写入失败的流被重置并且不再写入，其他的流不受影响
+type fanoutWriter struct {
+	streams []p2p.Stream
+	errs    []error
+}
+
+func (w *fanoutWriter) Write(b []byte) (int, error) {
+	live := w.streams[:0]
+	for _, st := range w.streams {
+		if _, err := st.Write(b); err != nil {
+			st.Reset()
+			w.errs = append(w.errs, err)
+			continue
+		}
+		live = append(live, st)
+	}
+	w.streams = live
+
+	return len(b), nil
+}
+
+// close 关闭所有还在写入的流
+func (w *fanoutWriter) close() {
+	for _, st := range w.streams {
+		if err := st.Close(); err != nil {
+			w.errs = append(w.errs, err)
+		}
+	}
+}
+
+// reset 重置所有还在写入的流
+func (w *fanoutWriter) reset() {
+	for _, st := range w.streams {
+		st.Reset()
+	}
+}
+
+// err 返回除了被对端重置以外的写入错误
+func (w *fanoutWriter) err() error {
+	var errs []error
+	for _, err := range w.errs {
+		if !errors.Is(err, p2p.ErrStreamReset) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// sendStream 在对端上打开一个流，发送消息之后将 r 中的数据通过流原样发送给对端
+func (s *FileServer) sendStream(peer p2p.Peer, msg MessageStoreFile, r io.Reader) error {
+	st, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+
+	msg.StreamID = st.ID()
+	if err := s.send(peer, &Message{Payload: msg}); err != nil {
+		st.Reset()
+		return err
+	}
+
+	if _, err := io.Copy(st, r); err != nil {
+		st.Reset()
+		return err
+	}
+
+	return st.Close()
 }
 
 // Stop 停止文件服务器
 func (s *FileServer) Stop() {
 	close(s.quitCh)
+
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
 }
 
 // OnPeer 是一个回调函数，当有新的对端连接时会被调用
 func (s *FileServer) OnPeer(p p2p.Peer) error {
 	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
-
 	s.peers[p.RemoteAddr().String()] = p
+	s.peerLock.Unlock()
 
 	slog.Info("connected with remote", "remote addr", p.RemoteAddr())
 
-	return nil
+	go s.acceptStreams(p)
+
+	// 发送可能阻塞，不能持有 peerLock，否则一个慢的对端会阻塞所有访问对端列表的操作
+	return s.send(p, &Message{Payload: MessageHello{ID: s.ID}})
+}
+
+// OnPeerDisconnect 是一个回调函数，当对端断开连接时会被调用，将对端从对端列表中移除
+// 对端节点仍然留在哈希环上，它负责的副本在它重新连接之前暂时不可用
+// 由本端发起的连接断开后会在后台不断重连。同一个地址已经换成了新的连接时，旧连接的断开不影响新的连接
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := p.RemoteAddr().String()
+	slog.Info("disconnected from remote", "remote addr", addr)
+
+	if s.peers[addr] != p {
+		return
+	}
+	delete(s.peers, addr)
+	delete(s.nodeIDs, addr)
+
+	if p.Outbound() {
+		go s.dialLoop(addr)
+	}
 }
 
 // loop 是一个无限循环，用于处理来自网络上的对端的消息
@@ -215,7 +1039,6 @@ func (s *FileServer) loop() {
 	for {
 		select {
 		case rpc := <-s.Transport.Consume():
-
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				slog.Error("failed to decode message", "error", err)
@@ -235,76 +1058,447 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from, v)
+	case MessageGetFileResponse:
+		return s.handleMessageGetFileResponse(from, v)
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageDeleteAck:
+		return s.handleMessageDeleteAck(from, v)
+	case MessageListKeys:
+		return s.handleMessageListKeys(from, v)
+	case MessageListKeysResponse:
+		return s.handleMessageListKeysResponse(from, v)
+	case MessageMerkleNodes:
+		return s.handleMessageMerkleNodes(from, v)
+	case MessageMerkleNodesResponse:
+		return s.handleMessageMerkleNodesResponse(from, v)
+	case MessageMerkleLeaves:
+		return s.handleMessageMerkleLeaves(from, v)
+	case MessageMerkleLeavesResponse:
+		return s.handleMessageMerkleLeavesResponse(from, v)
+	case MessageStoreHint:
+		return s.handleMessageStoreHint(from, v)
+	case MessageStoreAck:
+		return s.handleMessageStoreAck(from, v)
+	case MessageListVersions:
+		return s.handleMessageListVersions(from, v)
+	case MessageListVersionsResponse:
+		return s.handleMessageListVersionsResponse(from, v)
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[from]
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	// 经过认证的对端只能使用由它的公钥决定的 ID
+	if key := peer.PublicKey(); key != nil && p2p.KeyID(key) != msg.ID {
+		peer.Close()
+		return fmt.Errorf("peer (%s) authenticated as (%s) but claims to be (%s)", from, p2p.KeyID(key), msg.ID)
+	}
+
+	s.nodeIDs[from] = msg.ID
+	s.ring.Add(msg.ID)
+
+	slog.Info("peer joined the hash ring", "remote addr", from, "node", msg.ID)
+
+	// 对端重新连接之后，把替它暂存的副本发送给它
+	go s.replayHints(peer, msg.ID)
+
+	return nil
+}
+
+// streamKey 标识一个对端打开的流
+type streamKey struct {
+	addr string
+	id   uint64
+}
+
+// fileKey 标识一个存储的文件
+type fileKey struct {
+	id  string
+	key string
+}
+
+// acceptStreams 接受对端打开的流，等待描述流中数据的消息认领它们，直到连接断开
+// 流在消息之前打开，消息到达时流通常已经在等待。超时没有被认领的流被重置
+func (s *FileServer) acceptStreams(peer p2p.Peer) {
+	addr := peer.RemoteAddr().String()
+	for {
+		st, err := peer.AcceptStream()
+		if err != nil {
+			return
+		}
+
+		k := streamKey{addr: addr, id: st.ID()}
+		s.streamLock.Lock()
+		select {
+		case s.streamSlot(k) <- st:
+		default:
+			st.Reset()
+		}
+		s.streamLock.Unlock()
+
+		time.AfterFunc(s.RequestTimeout, func() { s.dropStream(k) })
+	}
+}
+
+// streamSlot 返回交付流 k 的通道，调用方需要持有 streamLock
+func (s *FileServer) streamSlot(k streamKey) chan p2p.Stream {
+	ch, ok := s.streams[k]
+	if !ok {
+		ch = make(chan p2p.Stream, 1)
+		s.streams[k] = ch
 	}
 
+	return ch
+}
+
+// dropStream 重置还没有被认领的流 k
+func (s *FileServer) dropStream(k streamKey) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+
+	ch, ok := s.streams[k]
+	if !ok {
+		return
+	}
+
+	select {
+	case st := <-ch:
+		delete(s.streams, k)
+		st.Reset()
+	default:
+	}
+}
+
+// expectStream 在单独的 goroutine 中等待对端打开的流 id，然后交给 handle 处理，不阻塞 loop
+// 返回的通道在流处理完或者等待超时后关闭
+func (s *FileServer) expectStream(from string, id uint64, handle func(peer p2p.Peer, st p2p.Stream) error) <-chan struct{} {
+	k := streamKey{addr: from, id: id}
+
+	s.streamLock.Lock()
+	ch := s.streamSlot(k)
+	s.streamLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			s.streamLock.Lock()
+			delete(s.streams, k)
+			s.streamLock.Unlock()
+		}()
+
+		timer := time.NewTimer(s.RequestTimeout)
+		defer timer.Stop()
+
+		var st p2p.Stream
+		select {
+		case st = <-ch:
+		case <-timer.C:
+			slog.Error("timed out waiting for stream", "peer", from, "stream", id)
+			return
+		case <-s.quitCh:
+			return
+		}
+
+		peer, ok := s.peer(from)
+		if !ok {
+			st.Reset()
+			return
+		}
+
+		if err := handle(peer, st); err != nil {
+			slog.Error("handle stream error: ", "error", err)
+		}
+	}()
+
+	return done
+}
+
+// trackWrite 记录一个正在写入 (id, key) 的流，done 关闭后写入结束
+func (s *FileServer) trackWrite(id string, key string, done <-chan struct{}) {
+	k := fileKey{id: id, key: key}
+
+	s.streamLock.Lock()
+	s.writes[k] = append(s.writes[k], done)
+	s.streamLock.Unlock()
+
+	go func() {
+		<-done
+
+		s.streamLock.Lock()
+		defer s.streamLock.Unlock()
+
+		s.writes[k] = slices.DeleteFunc(s.writes[k], func(ch <-chan struct{}) bool { return ch == done })
+		if len(s.writes[k]) == 0 {
+			delete(s.writes, k)
+		}
+	}()
+}
+
+// afterWrites 在 (id, key) 正在进行的写入都结束之后调用 handle，没有时直接调用。
+// 写入的数据在单独的流中到达，这样对端先写入再读取或者删除同一个文件时，后面的消息能看到写入的结果
+func (s *FileServer) afterWrites(id string, key string, handle func() error) error {
+	s.streamLock.Lock()
+	writes := slices.Clone(s.writes[fileKey{id: id, key: key}])
+	s.streamLock.Unlock()
+
+	if len(writes) == 0 {
+		return handle()
+	}
+
+	go func() {
+		for _, done := range writes {
+			<-done
+		}
+
+		if err := handle(); err != nil {
+			slog.Error("handle message error: ", "error", err)
+		}
+	}()
+
 	return nil
 }
 
 func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+	return s.afterWrites(msg.ID, msg.Key, func() error {
+		return s.serveFile(from, msg)
+	})
+}
+
+// serveFile 向对端发送它请求的文件，文件内容在单独的流中发送，不阻塞这个对端的其他消息
+func (s *FileServer) serveFile(from string, msg MessageGetFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := MessageGetFileResponse{RequestID: msg.RequestID, Node: s.ID}
+
+	if !s.store.HasVersion(msg.ID, msg.Key, msg.Version) {
+		fmt.Printf("[%s] asked for file (%s) but it does not exist on disk\n", s.Transport.Addr(), msg.Key)
+		return s.send(peer, &Message{Payload: resp})
 	}
 
 	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
 
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
+	fileSize, r, meta, err := s.store.ReadVersion(msg.ID, msg.Key, msg.Version)
 	if err != nil {
+		if sendErr := s.send(peer, &Message{Payload: resp}); sendErr != nil {
+			return sendErr
+		}
 		return err
 	}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing readCloser")
-		defer rc.Close()
-	}
+	resp.Found = true
+	resp.Size = fileSize
+	resp.Metadata = meta
+	if msg.SizeOnly {
+		r.Close()
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+		// 读取整个文件校验保存的数据，不阻塞其他的消息
+		go func() {
+			_, err := s.store.VerifyVersion(msg.ID, msg.Key, msg.Version, nil)
+			resp.Corrupt = errors.Is(err, ErrChecksumMismatch)
+			if err := s.send(peer, &Message{Payload: resp}); err != nil {
+				slog.Error("failed to send file version", "key", msg.Key, "peer", from, "error", err)
+			}
+		}()
+		return nil
 	}
 
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	st, err := peer.OpenStream()
 	if err != nil {
+		r.Close()
 		return err
 	}
 
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	resp.StreamID = st.ID()
+	if err := s.send(peer, &Message{Payload: resp}); err != nil {
+		r.Close()
+		st.Reset()
+		return err
+	}
+
+	go func() {
+		defer r.Close()
+
+		if _, err := io.Copy(st, r); err != nil {
+			st.Reset()
+			slog.Error("failed to send file", "key", msg.Key, "peer", from, "error", err)
+			return
+		}
+		st.Close()
+
+		fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), fileSize, from)
+	}()
+
+	return nil
+}
+
+func (s *FileServer) handleMessageGetFileResponse(from string, msg MessageGetFileResponse) error {
+	req, ok := s.pendingRequest(msg.RequestID)
+	if msg.StreamID == 0 {
+		if ok {
+			req.deliver(msg)
+		}
+		return nil
+	}
+
+	// 请求已经结束或者已经选中了其他对端，重置随后到来的流
+	if !ok || req.claimed {
+		s.expectStream(from, msg.StreamID, func(peer p2p.Peer, st p2p.Stream) error {
+			return st.Reset()
+		})
+		return nil
+	}
+
+	req.claimed = true
+	s.expectStream(from, msg.StreamID, func(peer p2p.Peer, st p2p.Stream) error {
+		select {
+		case req.streamCh <- fetchedStream{from: from, stream: st, size: msg.Size, meta: msg.Metadata}:
+			return nil
+		case <-req.doneCh:
+			return st.Reset()
+		}
+	})
 
 	return nil
 }
 
 func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+	// 之后本节点生成的版本都排在对端的这个版本之后
+	if ts, err := ParseVersion(msg.Metadata.VersionID); err == nil {
+		s.clock.Update(ts)
+	}
+
+	if !s.isNewer(msg.ID, msg.Key, msg.Metadata) {
+		// 本地的副本或者墓碑更新，不再接收对端发来的旧数据
+		s.expectStream(from, msg.StreamID, func(peer p2p.Peer, st p2p.Stream) error {
+			st.Reset()
+			return s.ackStore(peer, msg, ErrStaleWrite)
+		})
+		return nil
+	}
+
+	done := s.expectStream(from, msg.StreamID, func(peer p2p.Peer, st p2p.Stream) error {
+		n, err := s.store.WriteFull(msg.ID, msg.Key, msg.Name, st, msg.Size, msg.Metadata)
+		if err != nil {
+			st.Reset()
+			return errors.Join(err, s.ackStore(peer, msg, err))
+		}
+		st.Close()
+
+		fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+
+		return s.ackStore(peer, msg, nil)
+	})
+	s.trackWrite(msg.ID, msg.Key, done)
+
+	return nil
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	return s.afterWrites(msg.ID, msg.Key, func() error {
+		return s.deleteFile(from, msg)
+	})
+}
+
+// deleteFile 删除对端要求删除的副本并留下墓碑，然后回复确认
+func (s *FileServer) deleteFile(from string, msg MessageDeleteFile) error {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	// 之后本节点生成的版本都排在这次删除之后
+	s.clock.Update(msg.DeletedAt)
+
+	ack := MessageDeleteAck{RequestID: msg.RequestID}
+
+	// 删除之后又重新写入的文件不受这次删除的影响，WriteTombstone 返回 ErrStaleWrite
+	if err := s.store.WriteTombstone(msg.ID, msg.Key, msg.DeletedAt); err != nil {
+		ack.Err = fmt.Sprintf("[%s] delete (%s): %v", s.Transport.Addr(), msg.Key, err)
+	}
+
+	return s.send(peer, &Message{Payload: ack})
+}
+
+func (s *FileServer) handleMessageDeleteAck(from string, msg MessageDeleteAck) error {
+	if req, ok := s.pendingRequest(msg.RequestID); ok {
+		req.deliver(msg)
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageListKeys(from string, msg MessageListKeys) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	resp := MessageListKeysResponse{RequestID: msg.RequestID}
+
+	keys, err := s.store.List(msg.ID, msg.Prefix)
 	if err != nil {
-		return err
+		resp.Err = fmt.Sprintf("[%s] list (%s): %v", s.Transport.Addr(), msg.Prefix, err)
+	} else {
+		resp.Keys, resp.More = paginate(keys, msg.After, msg.Limit)
 	}
 
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	return s.send(peer, &Message{Payload: resp})
+}
 
-	peer.CloseStream()
+func (s *FileServer) handleMessageListKeysResponse(from string, msg MessageListKeysResponse) error {
+	if req, ok := s.pendingRequest(msg.RequestID); ok {
+		req.deliver(msg)
+	}
 
 	return nil
 }
 
-// bootstrapNetwork 启动网络
+// paginate 返回排好序的 keys 中排在 after 之后的至多 limit 个 key，more 表示后面是否还有
+func paginate(keys []KeyInfo, after string, limit int) (page []KeyInfo, more bool) {
+	start := sort.Search(len(keys), func(i int) bool { return keys[i].Key > after })
+	keys = keys[start:]
+
+	if len(keys) > limit {
+		return keys[:limit], true
+	}
+
+	return keys, false
+}
+
+// isNewer 判断 meta 对应的版本是否没有被本地保存的 (id, key) 的当前版本取代，并且比墓碑更新
+// 和当前的版本并发写入的版本不算过时，它们一起保留
+func (s *FileServer) isNewer(id string, key string, meta Metadata) bool {
+	if deletedAt, ok := s.store.Tombstone(id, key); ok && meta.timestamp().Compare(deletedAt) <= 0 {
+		return false
+	}
+
+	return !s.store.Stale(id, key, meta)
+}
+
+// bootstrapNetwork 启动网络，在后台不断重试连接引导节点，直到连接成功
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
 
-		go func(addr string) {
-			slog.Info("attempting connect with remote", "addr", addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				slog.Info("failed to dial", "err", err)
-			}
-		}(addr)
+		go s.dialLoop(addr)
 	}
 	return nil
 }
@@ -0,0 +1,886 @@
+package main
+
+import (
+	"distributed-file-store/p2p"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testServerConfig 是 makeTestServer 创建文件服务器时使用的设置
+type testServerConfig struct {
+	opts FileServerOpts
+	// network 不为空时服务器连接在内存网络上，不占用端口，可以在并行的测试中使用，否则使用 TCP
+	network *p2p.MemNetwork
+	// faults 不为空时在服务器的连接上注入故障
+	faults *p2p.FaultConfig
+	// allowlist 不为空时用 opts.Identity 和对端进行认证握手，TCP 的连接上还会建立 TLS 会话
+	allowlist *p2p.Allowlist
+}
+
+// testServerOption 修改 makeTestServer 使用的设置
+type testServerOption func(*testServerConfig)
+
+// withNodes 设置服务器启动时连接的引导节点
+func withNodes(nodes ...string) testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.opts.BootstrapNodes = nodes
+	}
+}
+
+// onNetwork 让服务器连接在内存网络上
+func onNetwork(network *p2p.MemNetwork) testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.network = network
+	}
+}
+
+// withFaults 在服务器的连接上注入 config 描述的故障，服务器的 Transport 是一个 *p2p.FaultTransport
+func withFaults(config p2p.FaultConfig) testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.faults = &config
+	}
+}
+
+// withIdentity 让服务器使用 identity 作为身份，allowlist 不为空时只和其中的对端建立连接
+func withIdentity(identity *p2p.Identity, allowlist *p2p.Allowlist) testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.opts.Identity = identity
+		cfg.allowlist = allowlist
+	}
+}
+
+// withOpts 修改服务器的其他设置，例如存储和副本数量
+func withOpts(fn func(*FileServerOpts)) testServerOption {
+	return func(cfg *testServerConfig) {
+		fn(&cfg.opts)
+	}
+}
+
+// makeTestServer 创建一个数据保存在临时目录中的文件服务器，默认通过 TCP 监听 listenAddr
+func makeTestServer(t *testing.T, listenAddr string, options ...testServerOption) *FileServer {
+	cfg := testServerConfig{
+		opts: FileServerOpts{
+			EncKey:              newEncryptionKey(),
+			StorageRoot:         t.TempDir(),
+			PathTransformFunc:   CASPathTransformFunc,
+			RequestTimeout:      time.Second,
+			ReconnectBackoff:    20 * time.Millisecond,
+			MaxReconnectBackoff: 100 * time.Millisecond,
+		},
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	handshake := p2p.NOPHandshakeFunc
+	if cfg.allowlist != nil {
+		handshake = p2p.AuthHandshakeFunc(cfg.opts.Identity, cfg.allowlist)
+	}
+
+	// 服务器创建之后才能设置回调，对端在服务器启动之后才会连接
+	var s *FileServer
+	onPeer := func(p p2p.Peer) error { return s.OnPeer(p) }
+	onPeerDisconnect := func(p p2p.Peer) { s.OnPeerDisconnect(p) }
+
+	var transport p2p.ConnWrapper
+	if cfg.network != nil {
+		transport = p2p.NewMemTransport(p2p.MemTransportOpts{
+			ListenAddr:       listenAddr,
+			Network:          cfg.network,
+			HandshakeFunc:    handshake,
+			OnPeer:           onPeer,
+			OnPeerDisconnect: onPeerDisconnect,
+		})
+	} else {
+		tcpTransportOpts := p2p.TCPTransportOpts{
+			ListenAddr:       listenAddr,
+			HandshakeFunc:    handshake,
+			Decoder:          p2p.DefaultDecoder{},
+			OnPeer:           onPeer,
+			OnPeerDisconnect: onPeerDisconnect,
+		}
+		if cfg.allowlist != nil {
+			tcpTransportOpts.TLSIdentity = cfg.opts.Identity
+		}
+		transport = p2p.NewTCPTransport(tcpTransportOpts)
+	}
+
+	cfg.opts.Transport = transport
+	if cfg.faults != nil {
+		cfg.opts.Transport = p2p.NewFaultTransport(transport, *cfg.faults)
+	}
+
+	s, err := NewFileServer(cfg.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// startServers 在后台启动一组文件服务器，测试结束时停止它们
+func startServers(t *testing.T, servers ...*FileServer) {
+	for _, s := range servers {
+		go s.Start()
+		t.Cleanup(s.Stop)
+	}
+}
+
+// startCluster 启动一组文件服务器，等到每个服务器的哈希环上都有这组服务器中所有的节点
+func startCluster(t *testing.T, servers ...*FileServer) {
+	startServers(t, servers...)
+
+	assert.Eventually(t, func() bool {
+		for _, s := range servers {
+			if s.ring.Len() != len(servers) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// numPeers 返回当前连接的对端数量
+func numPeers(s *FileServer) int {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	return len(s.peers)
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: 100 * time.Millisecond, max: time.Second}
+
+	for i, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		d := b.next()
+		assert.GreaterOrEqual(t, d, want/2, "attempt %d", i)
+		assert.LessOrEqual(t, d, want, "attempt %d", i)
+	}
+}
+
+func TestHandshakeTimeoutOption(t *testing.T) {
+	tr := p2p.NewMemTransport(p2p.MemTransportOpts{ListenAddr: "a", Network: p2p.NewMemNetwork(1)})
+
+	_, err := NewFileServer(FileServerOpts{Transport: tr, Backend: NewMemoryBackend(), HandshakeTimeout: time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, tr.HandshakeTimeout)
+
+	// 没有设置时使用默认值，经过 FaultTransport 同样传给被包装的 transport
+	s, err := NewFileServer(FileServerOpts{Transport: p2p.NewFaultTransport(tr, p2p.FaultConfig{}), Backend: NewMemoryBackend()})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultHandshakeTimeout, s.HandshakeTimeout)
+	assert.Equal(t, defaultHandshakeTimeout, tr.HandshakeTimeout)
+}
+
+func TestBootstrapRetriesUntilPeerStarts(t *testing.T) {
+	addrA, addrB := "127.0.0.1:30901", "127.0.0.1:30902"
+
+	a := makeTestServer(t, addrA, withNodes(addrB))
+	startServers(t, a)
+
+	// 引导节点还没有启动，a 的第一次连接会失败
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, numPeers(a))
+
+	b := makeTestServer(t, addrB)
+	startServers(t, b)
+
+	assert.Eventually(t, func() bool {
+		return numPeers(a) == 1 && numPeers(b) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// stalledPeer 是一个发送一直阻塞的对端
+type stalledPeer struct {
+	p2p.Peer
+	release chan struct{}
+}
+
+func (p stalledPeer) Send([]byte) error {
+	<-p.release
+	return nil
+}
+
+func (p stalledPeer) AcceptStream() (p2p.Stream, error) { return nil, net.ErrClosed }
+func (p stalledPeer) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 3000}
+}
+
+func TestOnPeerDoesNotHoldLockWhileSending(t *testing.T) {
+	t.Parallel()
+
+	s := makeTestServer(t, "a", onNetwork(p2p.NewMemNetwork(1)))
+	p := stalledPeer{release: make(chan struct{})}
+	defer close(p.release)
+
+	// 对端的 Hello 还没有发送出去时，对端列表依然可以访问
+	go s.OnPeer(p)
+	assert.Eventually(t, func() bool { return numPeers(s) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, s.connectedPeers(), 1)
+}
+
+func TestStaleDisconnectKeepsNewPeer(t *testing.T) {
+	t.Parallel()
+
+	s := makeTestServer(t, "a", onNetwork(p2p.NewMemNetwork(1)))
+	c1, _ := net.Pipe()
+	c2, _ := net.Pipe()
+	old, cur := p2p.NewTCPPeer(c1, false), p2p.NewTCPPeer(c2, false)
+	addr := cur.RemoteAddr().String()
+
+	s.peers[addr] = cur
+	s.nodeIDs[addr] = "b"
+
+	// 同一个地址上旧连接的断开不移除新的连接
+	s.OnPeerDisconnect(old)
+	assert.Equal(t, p2p.Peer(cur), s.peers[addr])
+	assert.Equal(t, "b", s.nodeIDs[addr])
+
+	s.OnPeerDisconnect(cur)
+	assert.Equal(t, 0, numPeers(s))
+	assert.NotContains(t, s.nodeIDs, addr)
+}
+
+// patternReader 不断产生重复的数据，本身不占用额外的内存
+type patternReader struct{}
+
+func (patternReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return len(b), nil
+}
+
+// measurePeakHeap 在 fn 运行期间不断采样，返回堆内存的峰值
+func measurePeakHeap(fn func()) uint64 {
+	var (
+		peak atomic.Uint64
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak.Load() {
+				peak.Store(ms.HeapInuse)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	fn()
+	close(done)
+	wg.Wait()
+
+	return peak.Load()
+}
+
+func TestStoreStreamsWithBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large upload in short mode")
+	}
+
+	a := makeTestServer(t, "127.0.0.1:30921", withNodes("127.0.0.1:30922"))
+	b := makeTestServer(t, "127.0.0.1:30922")
+
+	startCluster(t, b, a)
+
+	const fileSize = 256 << 20
+	key := "large.bin"
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	peak := measurePeakHeap(func() {
+		assert.Nil(t, a.Store(key, io.LimitReader(patternReader{}, fileSize)))
+
+		assert.Eventually(t, func() bool {
+			size, err := b.store.Stat(a.ID, hashKey(key))
+			return err == nil && size == encryptedSize(fileSize)
+		}, 30*time.Second, 50*time.Millisecond)
+	})
+
+	// 上传和复制都只应该使用固定大小的缓冲区，和文件大小无关
+	const limit = 32 << 20
+	assert.Less(t, peak-min(peak, before.HeapInuse), uint64(limit), "heap grew by %d MiB", (peak-before.HeapInuse)>>20)
+
+	size, err := a.store.Stat(a.ID, key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(fileSize), size)
+}
+
+func TestOverlappingGets(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:31011", withNodes("127.0.0.1:31012"))
+	b := makeTestServer(t, "127.0.0.1:31012")
+
+	startCluster(t, b, a)
+
+	// 每个文件都超过一个流的窗口，多个传输在同一个连接上交错进行
+	const fileSize = 1 << 20
+	keys := []string{"overlap/1", "overlap/2", "overlap/3", "overlap/4"}
+	for _, key := range keys {
+		assert.Nil(t, a.Store(key, io.LimitReader(patternReader{}, fileSize)))
+		// 副本还在写入时读取，读取要等写入完成
+		assert.Nil(t, a.store.Delete(a.ID, key))
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r, _, err := a.Get(key)
+			if !assert.Nil(t, err, key) {
+				return
+			}
+			if c, ok := r.(io.Closer); ok {
+				defer c.Close()
+			}
+
+			n, err := io.Copy(io.Discard, r)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(fileSize), n)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGetCorrelatesResponses(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b"))
+	b := makeTestServer(t, "b", onNetwork(network))
+
+	startCluster(t, b, a)
+
+	keys := []string{"correlated/1", "correlated/2", "correlated/3", "correlated/4"}
+	for _, key := range keys {
+		assert.Nil(t, a.Store(key, strings.NewReader("data of "+key)))
+	}
+	assert.Eventually(t, func() bool {
+		for _, key := range keys {
+			if !b.store.Has(a.ID, hashKey(key)) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 同时进行的请求各自收到自己请求的文件
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		assert.Nil(t, a.store.Delete(a.ID, key))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r, _, err := a.Get(key)
+			if !assert.Nil(t, err, key) {
+				return
+			}
+			data, err := io.ReadAll(r)
+			r.(io.Closer).Close()
+			assert.Nil(t, err)
+			assert.Equal(t, "data of "+key, string(data))
+		}()
+	}
+	wg.Wait()
+
+	// 没有对应请求的响应被忽略
+	assert.Nil(t, a.handleMessageGetFileResponse("b", MessageGetFileResponse{RequestID: generateID(), Found: true}))
+	a.pendingLock.Lock()
+	assert.Empty(t, a.pending)
+	a.pendingLock.Unlock()
+}
+
+func TestGetNotFound(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b"))
+	b := makeTestServer(t, "b", onNetwork(network))
+
+	startCluster(t, b, a)
+
+	// 所有对端都回复没有这个文件之后立即返回，不等待超时
+	start := time.Now()
+	_, _, err := a.Get("missing")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	assert.Less(t, time.Since(start), a.RequestTimeout)
+}
+
+func TestGetTimeout(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b"))
+	b := makeTestServer(t, "b", onNetwork(network))
+	a.RequestTimeout = 200 * time.Millisecond
+
+	startCluster(t, b, a)
+
+	// 对端收不到请求时在 RequestTimeout 之后返回错误
+	network.SetDropRate(1)
+	start := time.Now()
+	_, _, err := a.Get("unanswered")
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, ErrFileNotFound)
+	assert.GreaterOrEqual(t, time.Since(start), a.RequestTimeout)
+
+	a.pendingLock.Lock()
+	assert.Empty(t, a.pending)
+	a.pendingLock.Unlock()
+}
+
+func TestMemNetworkReplication(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	network.SetLatency(time.Millisecond)
+
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b", "c"))
+	b := makeTestServer(t, "b", onNetwork(network))
+	c := makeTestServer(t, "c", onNetwork(network))
+
+	startServers(t, b, c, a)
+
+	assert.Eventually(t, func() bool {
+		return a.ring.Len() == 3 && numPeers(a) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	key := "replicated"
+	assert.Nil(t, a.Store(key, strings.NewReader("replicated data")))
+	assert.Nil(t, a.store.Delete(a.ID, key))
+
+	// 和 b 之间的分区不影响从 c 获取文件
+	network.Partition("a", "b")
+	assert.Eventually(t, func() bool { return numPeers(a) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	r, _, err := a.Get(key)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "replicated data", string(data))
+
+	// 和所有副本之间都有分区时无法获取文件，分区恢复后重新连接
+	assert.Nil(t, a.store.Delete(a.ID, key))
+	network.Partition("a", "c")
+	assert.Eventually(t, func() bool { return numPeers(a) == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	_, _, err = a.Get(key)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	network.Heal("a", "b")
+	network.Heal("a", "c")
+	assert.Eventually(t, func() bool { return numPeers(a) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	_, _, err = a.Get(key)
+	assert.Nil(t, err)
+}
+
+func TestGetUnderInjectedFaults(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b"))
+	b := makeTestServer(t, "b", onNetwork(network), withFaults(p2p.FaultConfig{Seed: 7, Latency: time.Millisecond, Bandwidth: 10 << 20}))
+	faults := b.Transport.(*p2p.FaultTransport)
+
+	startCluster(t, b, a)
+
+	// 延迟和带宽限制不影响复制
+	key := "fragile"
+	want := strings.Repeat("fragile data ", 10000)
+	assert.Nil(t, a.Store(key, strings.NewReader(want)))
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// b 发出的数据被损坏、截断或者连接被重置时，Get 要么失败，要么返回完整正确的文件
+	faults.SetConfig(p2p.FaultConfig{CorruptRate: 0.2, PartialWriteRate: 0.02, ResetRate: 0.02})
+	for i := 0; i < 10; i++ {
+		a.store.Delete(a.ID, key)
+
+		r, _, err := a.Get(key)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(data))
+	}
+
+	// 故障消失之后重新连接，文件可以正常获取
+	faults.SetConfig(p2p.FaultConfig{})
+	assert.Eventually(t, func() bool {
+		a.store.Delete(a.ID, key)
+
+		r, _, err := a.Get(key)
+		if err != nil {
+			return false
+		}
+		data, err := io.ReadAll(r)
+		return err == nil && string(data) == want
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestListMergesPeersWithPagination(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30931", withNodes("127.0.0.1:30932"))
+	b := makeTestServer(t, "127.0.0.1:30932")
+
+	startCluster(t, b, a)
+
+	keys := []string{"logs/3", "logs/1", "logs/2", "logs/4", "other"}
+	for _, key := range keys {
+		assert.Nil(t, a.Store(key, strings.NewReader("data of "+key)))
+	}
+
+	assert.Eventually(t, func() bool {
+		remote, err := b.store.List(a.ID, "")
+		return err == nil && len(remote) == len(keys)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// 只在对端还保存着的文件也会被列出来
+	assert.Nil(t, a.store.Delete(a.ID, "logs/2"))
+
+	var listed []string
+	after := ""
+	for pages := 0; ; pages++ {
+		page, next, err := a.List("logs/", after, 3)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(page), 3)
+
+		for _, info := range page {
+			listed = append(listed, info.Key)
+			assert.Equal(t, int64(len("data of ")+len(info.Key)), info.Size)
+		}
+
+		if next == "" {
+			assert.Equal(t, 1, pages)
+			break
+		}
+		after = next
+	}
+	assert.Equal(t, []string{"logs/1", "logs/2", "logs/3", "logs/4"}, listed)
+
+	// 集群范围删除的文件不再出现
+	assert.Nil(t, a.Delete("logs/3"))
+	page, next, err := a.List("logs/", "", 0)
+	assert.Nil(t, err)
+	assert.Empty(t, next)
+	assert.Len(t, page, 3)
+}
+
+func TestDeleteWaitsForReplicaAcks(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b", "c"))
+	b := makeTestServer(t, "b", onNetwork(network), withNodes("c"))
+	c := makeTestServer(t, "c", onNetwork(network))
+	a.RequestTimeout = 200 * time.Millisecond
+
+	startCluster(t, c, b, a)
+
+	keys := []string{"deleted/acked", "deleted/unacked", "kept"}
+	for _, key := range keys {
+		assert.Nil(t, a.Store(key, strings.NewReader("data of "+key)))
+	}
+	assert.Eventually(t, func() bool {
+		for _, key := range keys {
+			if !b.store.Has(a.ID, hashKey(key)) || !c.store.Has(a.ID, hashKey(key)) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 所有副本确认之后返回，副本被删除并留下墓碑
+	key := "deleted/acked"
+	assert.Nil(t, a.Delete(key))
+	for _, s := range []*FileServer{b, c} {
+		assert.False(t, s.store.Has(a.ID, hashKey(key)))
+		_, ok := s.store.Tombstone(a.ID, hashKey(key))
+		assert.True(t, ok)
+	}
+
+	// 删除的文件不能再获取，也不会被列出
+	_, _, err := a.Get(key)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	_, _, err = a.Stat(key)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	listed, _, err := a.List("", "", 0)
+	assert.Nil(t, err)
+	assert.Len(t, listed, 2)
+	for _, info := range listed {
+		assert.NotEqual(t, key, info.Key)
+	}
+
+	// 副本收不到删除请求时超时返回错误，本地的文件依然被删除
+	network.SetDropRate(1)
+	key = "deleted/unacked"
+	err = a.Delete(key)
+	assert.ErrorContains(t, err, "timed out")
+	assert.False(t, a.store.Has(a.ID, key))
+	_, _, err = a.Get(key)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestTombstoneRejectsOlderStore(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b"))
+	b := makeTestServer(t, "b", onNetwork(network))
+
+	startCluster(t, b, a)
+
+	key := "resurrected"
+	assert.Nil(t, a.Store(key, strings.NewReader("old data")))
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 10*time.Millisecond)
+	old, err := a.store.Metadata(a.ID, key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, a.Delete(key))
+
+	// 删除之后才到达的旧版本被墓碑拒绝
+	forgetTombstone(t, a.store, a.ID, key)
+	_, err = a.store.WriteWithMetadata(a.ID, key, strings.NewReader("old data"), old)
+	assert.Nil(t, err)
+	peer, ok := a.peer("b")
+	assert.True(t, ok)
+
+	req := a.addPendingRequest(1)
+	defer a.removePendingRequest(req)
+	assert.Nil(t, a.sendEncrypted(key, "", []p2p.Peer{peer}, func(msg MessageStoreFile) any {
+		msg.RequestID = req.id
+		return msg
+	}))
+
+	select {
+	case resp := <-req.respCh:
+		assert.True(t, resp.(MessageStoreAck).Stale)
+	case <-time.After(time.Second):
+		t.Fatal("replica did not acknowledge the stale write")
+	}
+	assert.False(t, b.store.Has(a.ID, hashKey(key)))
+}
+
+func TestDeleteWithClockSkew(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b"))
+	b := makeTestServer(t, "b", onNetwork(network))
+
+	startCluster(t, b, a)
+
+	// a 见过一个时钟快了 30 秒的节点生成的版本，之后写入的版本也在物理时间的 30 秒之后
+	a.clock.Update(Timestamp{Wall: time.Now().Add(30 * time.Second).UnixNano()})
+
+	key := "skewed"
+	versionID, err := a.StoreWithMetadata(key, strings.NewReader("written ahead of time"), Metadata{})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 10*time.Millisecond)
+	meta, err := b.store.Metadata(a.ID, hashKey(key))
+	assert.Nil(t, err)
+	assert.True(t, meta.CreatedAt.After(time.Now()))
+
+	// 删除排在写入之后，副本不会因为删除的物理时间更早而保留下来
+	assert.Nil(t, a.Delete(key))
+	assert.False(t, b.store.Has(a.ID, hashKey(key)))
+
+	deletedAt, ok := b.store.Tombstone(a.ID, hashKey(key))
+	assert.True(t, ok)
+	written, err := ParseVersion(versionID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deletedAt.Compare(written))
+
+	// 删除之前写入的版本晚到时被墓碑拒绝，删除之后的写入不受影响
+	assert.False(t, b.isNewer(a.ID, hashKey(key), meta))
+	ts := a.clock.Now()
+	assert.True(t, b.isNewer(a.ID, hashKey(key), Metadata{CreatedAt: ts.Time(), VersionID: ts.String()}))
+}
+
+func TestDeleteNotResurrectedByOfflineReplica(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemNetwork(1)
+	a := makeTestServer(t, "a", onNetwork(network), withNodes("b", "c"))
+	b := makeTestServer(t, "b", onNetwork(network), withNodes("c"))
+	c := makeTestServer(t, "c", onNetwork(network))
+
+	for _, s := range []*FileServer{c, b, a} {
+		s.AntiEntropyInterval = 50 * time.Millisecond
+	}
+	startCluster(t, c, b, a)
+
+	key := "offline"
+	assert.Nil(t, a.Store(key, strings.NewReader("data on an offline replica")))
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hashKey(key)) && c.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// c 在删除时离线，它的副本没有被删除
+	network.Partition("a", "c")
+	network.Partition("b", "c")
+	assert.Eventually(t, func() bool { return numPeers(c) == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, a.Delete(key))
+	assert.True(t, c.store.Has(a.ID, hashKey(key)))
+
+	// c 重新连接之后它的副本被墓碑删除，不会复制回其他节点
+	network.Heal("a", "c")
+	network.Heal("b", "c")
+	assert.Eventually(t, func() bool {
+		_, deleted := c.store.Tombstone(a.ID, hashKey(key))
+		return deleted && !c.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.False(t, b.store.Has(a.ID, hashKey(key)))
+	assert.False(t, a.store.Has(a.ID, key))
+	_, _, err := a.Get(key)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestScrubRepairsCorruptFiles(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30941", withNodes("127.0.0.1:30942", "127.0.0.1:30943"))
+	b := makeTestServer(t, "127.0.0.1:30942", withNodes("127.0.0.1:30943"))
+	c := makeTestServer(t, "127.0.0.1:30943")
+
+	startCluster(t, c, b, a)
+
+	key := "reports/q3.pdf"
+	payload := strings.Repeat("quarterly numbers ", 1000)
+	assert.Nil(t, a.Store(key, strings.NewReader(payload)))
+
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hashKey(key)) && c.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// b 上的副本损坏后从 c 复制一份完好的密文
+	corruptBlob(t, b.store, a.ID, hashKey(key))
+	b.scrub()
+
+	stats := b.ScrubStats()
+	assert.Equal(t, 1, stats.Passes)
+	assert.Equal(t, int64(1), stats.Corrupt)
+	assert.Equal(t, int64(1), stats.Repaired)
+	_, err := b.store.Verify(a.ID, hashKey(key), nil)
+	assert.Nil(t, err)
+
+	// a 上的明文损坏后从副本获取并解密
+	corruptBlob(t, a.store, a.ID, key)
+	a.scrub()
+
+	stats = a.ScrubStats()
+	assert.Equal(t, int64(1), stats.Corrupt)
+	assert.Equal(t, int64(1), stats.Repaired)
+	assert.Equal(t, 1, stats.PassScanned)
+
+	r, _, err := a.Get(key)
+	assert.Nil(t, err)
+	b2, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, payload, string(b2))
+
+	// 再检查一遍不会发现新的损坏
+	a.scrub()
+	assert.Equal(t, int64(1), a.ScrubStats().Corrupt)
+
+	// 旧版本同样被检查，只有损坏的版本被重新获取，其他版本不受影响
+	old, err := a.store.Metadata(a.ID, key)
+	assert.Nil(t, err)
+	assert.Nil(t, a.Store(key, strings.NewReader("revised numbers")))
+	assert.Eventually(t, func() bool {
+		versions, err := b.store.Versions(a.ID, hashKey(key))
+		return err == nil && len(versions) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	corruptVersion(t, b.store, a.ID, hashKey(key), old.VersionID)
+	b.scrub()
+
+	stats = b.ScrubStats()
+	assert.Equal(t, int64(2), stats.Corrupt)
+	assert.Equal(t, int64(2), stats.Repaired)
+	versions, err := b.store.Versions(a.ID, hashKey(key))
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	for _, v := range versions {
+		_, err := b.store.VerifyVersion(a.ID, hashKey(key), v.VersionID, nil)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, old.VersionID, versions[1].VersionID)
+}
+
+func TestAuthenticatedPeers(t *testing.T) {
+	var identities []*p2p.Identity
+	for range 3 {
+		id, err := p2p.NewIdentity()
+		assert.Nil(t, err)
+		identities = append(identities, id)
+	}
+
+	// c 不在 allowlist 中
+	allowlist := p2p.NewAllowlist(identities[0].PublicKey(), identities[1].PublicKey())
+	a := makeTestServer(t, "127.0.0.1:31001", withIdentity(identities[0], allowlist))
+	b := makeTestServer(t, "127.0.0.1:31002", withIdentity(identities[1], allowlist), withNodes("127.0.0.1:31001"))
+	c := makeTestServer(t, "127.0.0.1:31003", withIdentity(identities[2], allowlist), withNodes("127.0.0.1:31001"))
+
+	// 节点 ID 由公钥决定
+	assert.Equal(t, identities[0].ID(), a.ID)
+	assert.Equal(t, identities[1].ID(), b.ID)
+
+	startServers(t, a, b, c)
+
+	assert.Eventually(t, func() bool {
+		return a.ring.Len() == 2 && b.ring.Len() == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// 不可信的节点无法连接，也就无法写入副本
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, numPeers(a))
+	assert.Equal(t, 0, numPeers(c))
+	assert.Equal(t, 1, c.ring.Len())
+
+	// 文件经过加密的会话复制到可信的节点
+	key := "secret.txt"
+	assert.Nil(t, a.Store(key, strings.NewReader("over tls")))
+	assert.Eventually(t, func() bool {
+		return b.store.Has(a.ID, hashKey(key))
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Nil(t, a.store.Delete(a.ID, key))
+	r, _, err := a.Get(key)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, "over tls", string(data))
+}
@@ -2,17 +2,54 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFoldName = "cannian1"
 
+// tombstoneSuffix 是墓碑文件的后缀，墓碑和它所标记的文件放在同一个目录下
+const tombstoneSuffix = ".tombstone"
+
+// tempFileInfix 出现在写入过程中的临时文件名里，临时文件名以 "." 开头，
+// 和目标文件放在同一个目录下，这样才能保证 rename 是原子的
+const tempFileInfix = ".tmp-"
+
+// metaSuffix 是 sidecar 元数据文件的后缀，blobInfix 出现在数据文件名里，
+// 一个 key 对应 <path>.meta 和 <path>.data-<随机 ID> 两个文件
+const (
+	metaSuffix = ".meta"
+	blobInfix  = ".data-"
+)
+
+// maxReadAttempts 是读取文件时因为并发的写入而重试的最大次数
+const maxReadAttempts = 3
+
+// quarantineDir 是被隔离的损坏文件所在的目录
+const quarantineDir = ".quarantine"
+
+// ErrChecksumMismatch 表示数据文件的内容和记录的大小或者 SHA-256 不一致
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// indexDir 是元数据索引所在的目录，每个 ID 的索引保存在 indexDir/<id> 下，每个 key 一条记录
+const indexDir = ".index"
+
+// hintDir 是替离线节点暂存的副本所在的目录，发给节点 target 的 id 的副本保存在 hintDir/<target>/<id> 下
+const hintDir = ".hints"
+
 // CASPathTransformFunc 是将一个 key 通过散列转化为一个路径的函数
 func CASPathTransformFunc(key string) PathKey {
 	hash := sha1.Sum([]byte(key)) // [20]byte -> []byte
@@ -33,6 +70,143 @@ func CASPathTransformFunc(key string) PathKey {
 	}
 }
 
+// KeyNotFoundError 表示要操作的 key 在存储中不存在
+type KeyNotFoundError struct {
+	ID  string
+	Key string
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("key (%s) not found for id (%s)", e.Key, e.ID)
+}
+
+// Is 让 errors.Is(err, os.ErrNotExist) 对 KeyNotFoundError 也成立
+func (e *KeyNotFoundError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// KeyInfo 是元数据索引中的一条记录
+type KeyInfo struct {
+	// Key 是文件原始的 key，CASPathTransformFunc 转换后的路径中不再包含它
+	Key string
+	// Size 和 Hash 是实际保存的数据的大小和 SHA-256，副本上保存的是加密后的数据
+	Size    int64
+	Hash    string
+	ModTime time.Time
+}
+
+// Metadata 是和文件一起保存的元数据
+type Metadata struct {
+	ContentType string
+	// Checksum 是文件明文的 SHA-256，由第一个写入文件的节点计算
+	Checksum  string
+	CreatedAt time.Time
+	// VersionID 是写入文件的节点用混合逻辑时钟生成的版本 ID，CreatedAt 是它的物理时间
+	VersionID string
+	// Parents 是写入这个版本的节点当时看到的当前版本，副本据此判断两个版本是否是并发写入的，
+	// 为空时无法判断，按照版本的先后取代
+	Parents []string `json:",omitempty"`
+	// Siblings 是和这个版本并发写入、还没有被解决的其他版本，只在读取时填写，不会保存
+	Siblings []string `json:",omitempty"`
+	// User 是用户自定义的键值对
+	User map[string]string
+}
+
+// newerThan 判断 m 是否是比 o 更新的版本，先比较创建时间，相同时再比较版本 ID
+func (m Metadata) newerThan(o Metadata) bool {
+	if !m.CreatedAt.Equal(o.CreatedAt) {
+		return m.CreatedAt.After(o.CreatedAt)
+	}
+
+	return m.VersionID > o.VersionID
+}
+
+// timestamp 返回写入这个版本时混合逻辑时钟的时间戳，没有版本 ID 时使用创建时间
+func (m Metadata) timestamp() Timestamp {
+	if ts, err := ParseVersion(m.VersionID); err == nil {
+		return ts
+	}
+
+	return Timestamp{Wall: m.CreatedAt.UnixNano()}
+}
+
+// sameVersion 判断 m 和 o 是否是同一个版本
+func (m Metadata) sameVersion(o Metadata) bool {
+	return m.CreatedAt.Equal(o.CreatedAt) && m.VersionID == o.VersionID
+}
+
+// objectVersion 是一个文件的一个版本
+type objectVersion struct {
+	Metadata
+	// Blob 是数据文件的文件名，和 sidecar 在同一个目录下
+	Blob string
+	// Size 和 Hash 是数据文件的大小和 SHA-256，用于检查数据文件是否损坏
+	Size int64
+	Hash string
+}
+
+// VersionInfo 是一个文件的一个版本的信息
+type VersionInfo struct {
+	VersionID string
+	// Size 是实际保存的数据的大小，副本上保存的是加密后的数据
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+	// Latest 表示这是文件当前的版本
+	Latest bool
+	// Sibling 表示这是和当前的版本并发写入、还没有被解决的版本
+	Sibling bool
+}
+
+// sidecar 是和数据文件放在同一个目录下的元数据文件，也是写入的提交点：
+// 数据先写入一个唯一命名的数据文件，sidecar 被原子地替换之后新的数据才对读取可见，
+// 因此读取到的元数据和数据总是一致的
+type sidecar struct {
+	// objectVersion 是文件当前的版本
+	objectVersion
+	// Key 是写入时使用的 key，Name 是文件原始的 key，副本上的 Key 是散列过的
+	Key  string
+	Name string
+	// Siblings 是和当前的版本并发写入的其他版本，从新到旧排列
+	Siblings []objectVersion `json:",omitempty"`
+	// History 是保留下来的旧版本，从新到旧排列
+	History []objectVersion `json:",omitempty"`
+}
+
+// heads 返回当前的版本和与它并发的版本
+func (sc sidecar) heads() []objectVersion {
+	return append([]objectVersion{sc.objectVersion}, sc.Siblings...)
+}
+
+// versions 返回 sidecar 中所有的版本，先是当前的版本和与它并发的版本，然后是从新到旧排列的旧版本
+func (sc sidecar) versions() []objectVersion {
+	return append(sc.heads(), sc.History...)
+}
+
+// version 返回版本 ID 为 versionID 的版本，versionID 为空时返回当前的版本
+// 返回的是当前的版本或者与它并发的版本时，在元数据中填写其他并发的版本
+func (sc sidecar) version(versionID string) (objectVersion, bool) {
+	heads := sc.heads()
+	for i, v := range sc.versions() {
+		if len(versionID) != 0 && v.VersionID != versionID {
+			continue
+		}
+
+		if i < len(heads) {
+			v.Siblings = nil
+			for j, h := range heads {
+				if j != i {
+					v.Siblings = append(v.Siblings, h.VersionID)
+				}
+			}
+		}
+
+		return v, true
+	}
+
+	return objectVersion{}, false
+}
+
 // PathTransformFunc 用于将一个key转换为一个路径
 type PathTransformFunc func(string) PathKey
 
@@ -55,9 +229,15 @@ func (p PathKey) FullPath() string {
 
 // StoreOpts 保存了一个 Store 的配置
 type StoreOpts struct {
-	// Root 是存储文件的根目录，包含系统所有的文件夹/文件
+	// Root 是存储文件的根目录，包含系统所有的文件夹/文件，只在没有指定 Backend 时使用
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// Backend 是保存文件的存储介质，为空时使用 Root 目录下的本地文件系统
+	Backend Backend
+	// MaxVersions 是每个文件最多保留的版本数量，包括当前的版本，为 0 时只保留当前的版本
+	MaxVersions int
+	// Resolver 用于解决并发写入的版本之间的冲突，为空时将它们都保留为当前的版本
+	Resolver ConflictResolver
 }
 
 // DefaultPathTransformFunc 是一个默认的 PathTransformFunc
@@ -70,6 +250,19 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 
 type Store struct {
 	StoreOpts
+
+	// mu 串行化 sidecar 的替换和删除，保证被替换掉的数据文件能被正确地清理
+	mu sync.Mutex
+
+	// locksMu 保护 keyLocks，keyLocks 为每个正在写入或者删除的 (id, key) 保存一个锁
+	locksMu  sync.Mutex
+	keyLocks map[string]*keyLock
+}
+
+// keyLock 是一个 (id, key) 的锁，refs 是持有或者等待它的调用数，为 0 时删除
+type keyLock struct {
+	sync.Mutex
+	refs int
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -81,88 +274,853 @@ func NewStore(opts StoreOpts) *Store {
 		opts.Root = defaultRootFoldName
 	}
 
+	if opts.Backend == nil {
+		opts.Backend = NewFSBackend(opts.Root)
+	}
+
 	return &Store{
 		StoreOpts: opts,
+		keyLocks:  make(map[string]*keyLock),
+	}
+}
+
+// lockKey 锁住 (id, key) 并返回解锁的函数。墓碑的比较和写入与文件的提交在这个锁下串行执行，
+// 删除不会覆盖同时提交的更新的文件，更旧的文件也不会在墓碑写入之后提交
+func (s *Store) lockKey(id string, key string) func() {
+	name := s.name(id, key)
+
+	s.locksMu.Lock()
+	l, ok := s.keyLocks[name]
+	if !ok {
+		l = &keyLock{}
+		s.keyLocks[name] = l
+	}
+	l.refs++
+	s.locksMu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		s.locksMu.Lock()
+		defer s.locksMu.Unlock()
+
+		if l.refs--; l.refs == 0 {
+			delete(s.keyLocks, name)
+		}
 	}
 }
 
+// name 返回 key 在后端中对应的文件名
+func (s *Store) name(id string, key string) string {
+	return path.Join(id, s.PathTransformFunc(key).FullPath())
+}
+
+// indexName 返回 key 的索引记录在后端中对应的文件名
+func (s *Store) indexName(id string, key string) string {
+	hash := sha1.Sum([]byte(key))
+	return path.Join(indexDir, id, hex.EncodeToString(hash[:]))
+}
+
+// blobName 返回 key 的数据文件在后端中对应的文件名，blob 是 sidecar 中记录的数据文件名
+func (s *Store) blobName(id string, key string, blob string) string {
+	return path.Join(path.Dir(s.name(id, key)), blob)
+}
+
+// sidecar 读取 key 的元数据文件，key 不存在时返回 *KeyNotFoundError
+func (s *Store) sidecar(id string, key string) (sidecar, error) {
+	sc, err := s.readSidecar(s.name(id, key) + metaSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return sidecar{}, &KeyNotFoundError{ID: id, Key: key}
+	}
+
+	return sc, err
+}
+
+func (s *Store) readSidecar(name string) (sidecar, error) {
+	f, err := s.Backend.Open(name)
+	if err != nil {
+		return sidecar{}, err
+	}
+	defer f.Close()
+
+	var sc sidecar
+	if err := json.NewDecoder(f).Decode(&sc); err != nil {
+		return sidecar{}, fmt.Errorf("corrupt metadata [%s]: %w", name, err)
+	}
+
+	return sc, nil
+}
+
+func (s *Store) writeSidecar(id string, key string, sc sidecar) error {
+	return s.encode(s.name(id, key)+metaSuffix, sc)
+}
+
+// encode 将 v 编码为 JSON 写入后端中的文件 name
+func (s *Store) encode(name string, v any) error {
+	w, err := s.Backend.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Commit()
+}
+
 func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	_, err := s.Backend.Stat(s.name(id, key) + metaSuffix)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// Stat 返回 key 对应文件的大小，文件不存在时返回 *KeyNotFoundError
+func (s *Store) Stat(id string, key string) (int64, error) {
+	sc, err := s.sidecar(id, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return sc.Size, nil
+}
+
+// Metadata 返回 key 对应文件的元数据，文件不存在时返回 *KeyNotFoundError
+func (s *Store) Metadata(id string, key string) (Metadata, error) {
+	sc, err := s.sidecar(id, key)
+	if err != nil {
+		return Metadata{}, err
+	}
 
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, os.ErrNotExist)
+	v, _ := sc.version("")
+	return v.Metadata, nil
 }
 
+// Stale 判断 meta 对应的版本是否已经被 key 当前的版本取代，key 不存在时返回 false
+func (s *Store) Stale(id string, key string, meta Metadata) bool {
+	sc, err := s.sidecar(id, key)
+	if err != nil {
+		return false
+	}
+
+	return sc.place(objectVersion{Metadata: meta}).stale
+}
+
+// Clear 删除存储中的所有文件
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	return s.Backend.Walk(".", func(name string, _ fs.FileInfo) error {
+		return s.Backend.Remove(name)
+	})
 }
 
-// Delete 从磁盘上删除一个 key 对应的文件
+// Delete 删除一个 key 对应的文件，key 不存在时返回 *KeyNotFoundError
 func (s *Store) Delete(id string, key string) error {
-	pathKey := s.PathTransformFunc(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(id, key)
+}
+
+// remove 删除 key 对应的 sidecar、数据文件和索引记录，调用时必须持有 s.mu
+func (s *Store) remove(id string, key string) error {
+	sc, err := s.sidecar(id, key)
+	if err != nil {
+		return err
+	}
+
+	// 先删除提交点，之后数据文件就不再可见
+	if err := s.Backend.Remove(s.name(id, key) + metaSuffix); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &KeyNotFoundError{ID: id, Key: key}
+		}
+		return err
+	}
+
+	for _, v := range sc.versions() {
+		if err := s.Backend.Remove(s.blobName(id, key, v.Blob)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	log.Printf("deleted [%s] from disk\n", s.PathTransformFunc(key).FullPath())
+
+	if err := s.Backend.Remove(s.indexName(id, key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// tombstone 是墓碑文件的内容
+type tombstone struct {
+	Key string
+	// Version 是删除时混合逻辑时钟的时间戳，和文件的版本 ID 按同样的顺序比较
+	Version string
+}
+
+// StoredTombstone 是存储中的一个墓碑
+type StoredTombstone struct {
+	ID        string
+	Key       string
+	DeletedAt Timestamp
+}
+
+// WriteTombstone 删除 key 对应的文件，并记录 key 在混合逻辑时钟的 deletedAt 时被删除，
+// 这样之前离线的副本在之后同步时就不会把文件重新带回来。
+// 文件的当前版本在 deletedAt 之后写入时保留文件并返回 ErrStaleWrite，已有更新的墓碑时不做任何修改
+func (s *Store) WriteTombstone(id string, key string, deletedAt Timestamp) error {
+	defer s.lockKey(id, key)()
+
+	if sc, err := s.sidecar(id, key); err == nil && sc.timestamp().Compare(deletedAt) > 0 {
+		return fmt.Errorf("tombstone (%s): current version %s was written after the delete: %w", key, sc.VersionID, ErrStaleWrite)
+	}
+
+	if prev, ok := s.Tombstone(id, key); ok && prev.Compare(deletedAt) >= 0 {
+		return nil
+	}
 
-	defer func() {
-		log.Printf("deleted [%s] from disk\n", pathKey.FullPath())
-	}()
+	if err := s.Delete(id, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+	return s.encode(s.name(id, key)+tombstoneSuffix, tombstone{Key: key, Version: deletedAt.String()})
+}
+
+// Tombstone 返回一个 key 被删除时的混合逻辑时钟时间戳，没有墓碑时 ok 为 false
+func (s *Store) Tombstone(id string, key string) (deletedAt Timestamp, ok bool) {
+	_, deletedAt, err := s.readTombstone(s.name(id, key) + tombstoneSuffix)
+	if err != nil {
+		return Timestamp{}, false
+	}
 
-	// todo: 这种删除方式可能导致其他通过散列函数生成文件名前面的pad与想要删除的文件相同的文件被删除
-	return os.RemoveAll(firstPathNameWithRoot)
+	return deletedAt, true
+}
+
+// readTombstone 读取一个墓碑文件，返回被删除的 key 和删除时的时间戳
+func (s *Store) readTombstone(name string) (string, Timestamp, error) {
+	f, err := s.Backend.Open(name)
+	if err != nil {
+		return "", Timestamp{}, err
+	}
+	defer f.Close()
+
+	var ts tombstone
+	if err := json.NewDecoder(f).Decode(&ts); err != nil {
+		return "", Timestamp{}, fmt.Errorf("tombstone (%s): %w", name, err)
+	}
+
+	deletedAt, err := ParseVersion(ts.Version)
+	if err != nil {
+		return "", Timestamp{}, fmt.Errorf("tombstone (%s): %w", name, err)
+	}
+
+	return ts.Key, deletedAt, nil
+}
+
+// Tombstones 返回存储中所有的墓碑
+func (s *Store) Tombstones() ([]StoredTombstone, error) {
+	var tombstones []StoredTombstone
+
+	err := s.Backend.Walk(".", func(name string, _ fs.FileInfo) error {
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, tombstoneSuffix) || isTempFile(path.Base(name)) {
+			return nil
+		}
+
+		key, deletedAt, err := s.readTombstone(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			// 遍历的过程中被删除
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id, _, _ := strings.Cut(name, "/")
+		tombstones = append(tombstones, StoredTombstone{ID: id, Key: key, DeletedAt: deletedAt})
+
+		return nil
+	})
+
+	return tombstones, err
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
+// WriteWithMetadata 和 Write 一样，同时保存文件的元数据
+// meta 中的 Checksum 为空时使用写入数据的 SHA-256，CreatedAt 为空时使用当前时间
+func (s *Store) WriteWithMetadata(id string, key string, r io.Reader, meta Metadata) (int64, error) {
+	return s.writeAtomic(id, key, key, meta, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// WriteFull 和 Write 一样，但只有从 r 中读到完整的 size 字节后才会提交文件，
+// 用于接收对端发来的流，连接中途断开时不会留下不完整的文件
+// name 是文件原始的 key，记录在索引中，副本上的 key 是散列过的
+func (s *Store) WriteFull(id string, key string, name string, r io.Reader, size int64, meta Metadata) (int64, error) {
+	return s.writeAtomic(id, key, name, meta, copyFull(r, size))
+}
+
+// copyFull 返回一个从 r 中复制 size 字节的 copyFn，读到的数据不足 size 字节时返回错误
+func copyFull(r io.Reader, size int64) func(io.Writer) (int64, error) {
+	return func(w io.Writer) (int64, error) {
+		n, err := io.Copy(w, io.LimitReader(r, size))
+		if err == nil && n != size {
+			err = fmt.Errorf("%w: received %d of %d bytes", io.ErrUnexpectedEOF, n, size)
+		}
+		return n, err
 	}
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+}
+
+// WriteDecrypt 将 r 中的加密流解密后写入磁盘，校验失败的数据不会被提交
+func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader, meta Metadata) (int64, error) {
+	return s.writeAtomic(id, key, key, meta, func(w io.Writer) (int64, error) {
+		n, err := copyDecrypt(encKey, r, w)
+		return int64(n), err
+	})
 }
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
-	return s.readStream(id, key)
+	size, r, _, err := s.ReadWithMetadata(id, key)
+	return size, r, err
 }
 
-func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+// ReadWithMetadata 打开 key 对应的文件，同时返回它的元数据
+func (s *Store) ReadWithMetadata(id string, key string) (int64, io.ReadCloser, Metadata, error) {
+	return s.ReadVersion(id, key, "")
+}
 
-	file, err := os.Open(fullPathWithRoot)
+// ReadVersion 打开 key 的版本 versionID，同时返回它的元数据，versionID 为空时打开当前的版本
+// 版本不存在时返回 *KeyNotFoundError
+func (s *Store) ReadVersion(id string, key string, versionID string) (int64, io.ReadCloser, Metadata, error) {
+	v, file, err := s.open(id, key, versionID)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, Metadata{}, err
 	}
 
-	fi, err := file.Stat()
+	return v.Size, file, v.Metadata, nil
+}
+
+// HasVersion 判断 key 是否有版本 versionID
+func (s *Store) HasVersion(id string, key string, versionID string) bool {
+	sc, err := s.sidecar(id, key)
 	if err != nil {
-		return 0, nil, err
+		return false
 	}
 
-	return fi.Size(), file, nil
+	_, ok := sc.version(versionID)
+	return ok
 }
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key) // 通过传入的规则函数将 key 转化为路径
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+// Versions 返回 key 所有保留下来的版本，从新到旧排列，key 不存在时返回 *KeyNotFoundError
+func (s *Store) Versions(id string, key string) ([]VersionInfo, error) {
+	sc, err := s.sidecar(id, key)
+	if err != nil {
 		return nil, err
 	}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	var versions []VersionInfo
+	for i, v := range sc.versions() {
+		versions = append(versions, VersionInfo{
+			VersionID: v.VersionID,
+			Size:      v.Size,
+			Checksum:  v.Checksum,
+			CreatedAt: v.CreatedAt,
+			Latest:    i == 0,
+			Sibling:   i > 0 && i <= len(sc.Siblings),
+		})
+	}
+
+	return versions, nil
+}
+
+// open 打开 key 的版本 versionID 对应的数据文件，versionID 为空时打开当前的版本
+func (s *Store) open(id string, key string, versionID string) (objectVersion, fs.File, error) {
+	for attempt := 1; ; attempt++ {
+		sc, err := s.sidecar(id, key)
+		if err != nil {
+			return objectVersion{}, nil, err
+		}
+
+		v, ok := sc.version(versionID)
+		if !ok {
+			return objectVersion{}, nil, &KeyNotFoundError{ID: id, Key: key + "@" + versionID}
+		}
+
+		file, err := s.Backend.Open(s.blobName(id, key, v.Blob))
+		// 读取 sidecar 之后，数据文件可能已经被并发的写入替换或者删除了，重新读取 sidecar
+		if errors.Is(err, fs.ErrNotExist) && attempt < maxReadAttempts {
+			continue
+		}
+		if err != nil {
+			return objectVersion{}, nil, err
+		}
+
+		return v, file, nil
+	}
+}
+
+// Verify 重新计算 key 当前的版本的数据文件的 SHA-256，和写入时记录的值比较，
+// 不一致时返回的错误满足 errors.Is(err, ErrChecksumMismatch)
+// 读取的数据同时写入 w，调用者可以用它来限制读取的速度，w 可以为 nil
+func (s *Store) Verify(id string, key string, w io.Writer) (int64, error) {
+	return s.VerifyVersion(id, key, "", w)
+}
+
+// VerifyVersion 和 Verify 一样，但是检查的是 key 的版本 versionID，versionID 为空时检查当前的版本
+func (s *Store) VerifyVersion(id string, key string, versionID string, w io.Writer) (int64, error) {
+	sc, file, err := s.open(id, key, versionID)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if w == nil {
+		w = io.Discard
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(hash, w), file)
+	if err != nil {
+		return n, err
+	}
+
+	// 每个版本写入时都记录了 SHA-256，sidecar 中缺少它也说明文件已经损坏
+	if n != sc.Size || hex.EncodeToString(hash.Sum(nil)) != sc.Hash {
+		return n, fmt.Errorf("key (%s) version (%s) for id (%s): %w", key, sc.VersionID, id, ErrChecksumMismatch)
+	}
+
+	return n, nil
+}
+
+// Quarantine 将 key 的版本 versionID 的数据文件移动到隔离目录中，versionID 为空时隔离当前的版本。
+// 其他版本保留在存储中，被隔离的是当前的版本时，与它并发的版本或者最新的旧版本成为当前的版本，
+// 没有其他版本时这个 key 在存储中不再存在。返回文件原始的 key，用于从其他节点重新获取这个版本
+func (s *Store) Quarantine(id string, key string, versionID string) (name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, err := s.sidecar(id, key)
+	if err != nil {
+		return "", err
+	}
+
+	v, ok := sc.version(versionID)
+	if !ok {
+		return "", &KeyNotFoundError{ID: id, Key: key + "@" + versionID}
+	}
+	v.Siblings = nil
+
+	// 隔离区中的 sidecar 只记录被隔离的版本
+	dst := path.Join(quarantineDir, id, v.Blob)
+	if err := s.copy(s.blobName(id, key, v.Blob), dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if err := s.encode(dst+metaSuffix, sidecar{objectVersion: v, Key: sc.Key, Name: sc.Name}); err != nil {
+		return "", err
+	}
+
+	log.Printf("quarantined version (%s) of [%s] to [%s]\n", v.VersionID, s.PathTransformFunc(key).FullPath(), dst)
+
+	quarantined := func(o objectVersion) bool { return o.Blob == v.Blob }
+	heads := slices.DeleteFunc(sc.heads(), quarantined)
+	history := slices.DeleteFunc(slices.Clone(sc.History), quarantined)
+	if len(heads)+len(history) == 0 {
+		return sc.Name, s.remove(id, key)
+	}
+	if len(heads) == 0 {
+		heads, history = history[:1], history[1:]
+	}
+
+	rest := sidecar{
+		objectVersion: heads[0],
+		Key:           sc.Key,
+		Name:          sc.Name,
+		Siblings:      heads[1:],
+		History:       history,
+	}
+	if err := s.writeSidecar(id, key, rest); err != nil {
+		return "", err
+	}
+
+	if err := s.Backend.Remove(s.blobName(id, key, v.Blob)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	// 当前的版本变了，索引中记录的也要跟着改变
+	if rest.Blob == sc.Blob {
+		return sc.Name, nil
+	}
+
+	return sc.Name, s.writeIndex(id, key, KeyInfo{
+		Key:     sc.Name,
+		Size:    rest.Size,
+		Hash:    rest.Hash,
+		ModTime: time.Now().UTC(),
+	})
+}
+
+// copy 在后端中复制一个文件
+func (s *Store) copy(src string, dst string) error {
+	r, err := s.Backend.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := s.Backend.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Commit()
+}
 
-	return os.Create(fullPathWithRoot)
+// StoredKey 是存储中的一个文件
+type StoredKey struct {
+	ID  string
+	Key string
+	// Name 是文件原始的 key
+	Name string
+}
+
+// Keys 返回存储中所有的文件
+func (s *Store) Keys() ([]StoredKey, error) {
+	var keys []StoredKey
+
+	err := s.Backend.Walk(".", func(name string, _ fs.FileInfo) error {
+		// 索引、隔离区等内部目录都以 "." 开头
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, metaSuffix) || isTempFile(path.Base(name)) {
+			return nil
+		}
+
+		sc, err := s.readSidecar(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("skipping [%s]: %v\n", name, err)
+			return nil
+		}
+		if len(sc.Key) == 0 {
+			return nil
+		}
+
+		id, _, _ := strings.Cut(name, "/")
+		keys = append(keys, StoredKey{ID: id, Key: sc.Key, Name: sc.Name})
+
+		return nil
+	})
+
+	return keys, err
 }
 
 // writeStream 将一个流写入到磁盘上
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	return s.WriteWithMetadata(id, key, r, Metadata{})
+}
+
+// writeAtomic 将 copyFn 写出的数据写入一个新的数据文件，copyFn 成功后提交，
+// 再原子地替换 sidecar，之后新的数据和元数据才对读取可见。
+// 失败时丢弃已经写入的数据，原来的文件保持不变。提交之后以 name 为原始 key 更新索引
+// 比墓碑旧的版本不会被提交，返回 ErrStaleWrite
+func (s *Store) writeAtomic(id string, key string, name string, meta Metadata, copyFn func(io.Writer) (int64, error)) (int64, error) {
+	n, sc, err := s.writeBlob(id, key, name, meta, copyFn, func(v objectVersion) (sidecar, error) {
+		defer s.lockKey(id, key)()
+
+		if deletedAt, ok := s.Tombstone(id, key); ok && v.timestamp().Compare(deletedAt) <= 0 {
+			return sidecar{}, fmt.Errorf("store (%s): version %s is older than the delete at %s: %w", key, v.VersionID, deletedAt, ErrStaleWrite)
+		}
+
+		sc, err := s.commit(id, key, name, v)
+		if err != nil {
+			return sidecar{}, err
+		}
+
+		// 重新写入的文件比之前的删除更新，墓碑不再有效
+		if err := s.Backend.Remove(s.name(id, key) + tombstoneSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return sidecar{}, err
+		}
+
+		return sc, nil
+	})
 	if err != nil {
-		return 0, err
+		return n, err
+	}
+
+	// 写入的可能是一个旧版本，索引中记录的总是当前的版本
+	info := KeyInfo{
+		Key:     name,
+		Size:    sc.Size,
+		Hash:    sc.Hash,
+		ModTime: time.Now().UTC(),
+	}
+
+	return n, s.writeIndex(id, key, info)
+}
+
+// writeBlob 写入数据文件并用 commitFn 提交 sidecar，不修改索引，返回提交之后的 sidecar
+func (s *Store) writeBlob(id string, key string, name string, meta Metadata, copyFn func(io.Writer) (int64, error), commitFn func(objectVersion) (sidecar, error)) (int64, sidecar, error) {
+	blob := path.Base(s.name(id, key)) + blobInfix + generateID()[:16]
+
+	w, err := s.Backend.Create(s.blobName(id, key, blob))
+	if err != nil {
+		return 0, sidecar{}, err
+	}
+
+	hash := sha256.New()
+	n, err := copyFn(io.MultiWriter(w, hash))
+	if err != nil {
+		w.Abort()
+		return n, sidecar{}, err
+	}
+
+	if err := w.Commit(); err != nil {
+		return n, sidecar{}, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	meta.Siblings = nil
+	if len(meta.Checksum) == 0 {
+		meta.Checksum = sum
+	}
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+
+	v := objectVersion{
+		Metadata: meta,
+		Blob:     blob,
+		Size:     n,
+		Hash:     sum,
+	}
+
+	sc, err := commitFn(v)
+	if err != nil {
+		s.Backend.Remove(s.blobName(id, key, blob))
+		return n, sidecar{}, err
+	}
+
+	return n, sc, nil
+}
+
+// commit 将版本 v 加入 key 的 sidecar 并原子地替换原来的 sidecar。
+// v 取代它的所有祖先版本，和当前的版本并发时与它一起保留，除非 Resolver 选出了唯一的当前版本；
+// 相同的版本被 v 替换，超过 MaxVersions 的旧版本和它们的数据文件被删除
+func (s *Store) commit(id string, key string, name string, v objectVersion) (sidecar, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := placement{heads: []objectVersion{v}}
+	if prev, err := s.sidecar(id, key); err == nil {
+		p = prev.place(v)
+	}
+
+	newest := func(vs []objectVersion) {
+		sort.SliceStable(vs, func(i, j int) bool { return vs[i].newerThan(vs[j].Metadata) })
+	}
+	newest(p.heads)
+
+	if s.Resolver != nil && len(p.heads) > 1 {
+		p.heads, p.history = s.resolve(p.heads, p.history)
+	}
+
+	newest(p.history)
+	if limit := max(max(s.MaxVersions, 1)-len(p.heads), 0); len(p.history) > limit {
+		p.history, p.dropped = p.history[:limit], append(p.dropped, p.history[limit:]...)
+	}
+
+	sc := sidecar{
+		objectVersion: p.heads[0],
+		Key:           key,
+		Name:          name,
+		Siblings:      p.heads[1:],
+		History:       p.history,
+	}
+
+	if err := s.writeSidecar(id, key, sc); err != nil {
+		return sidecar{}, err
+	}
+
+	for _, d := range p.dropped {
+		if err := s.Backend.Remove(s.blobName(id, key, d.Blob)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return sidecar{}, err
+		}
+	}
+
+	return sc, nil
+}
+
+// writeIndex 写入 key 的索引记录
+func (s *Store) writeIndex(id string, key string, info KeyInfo) error {
+	w, err := s.Backend.Create(s.indexName(id, key))
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Commit()
+}
+
+// List 从索引中读取 id 下所有原始 key 以 prefix 开头的文件，按 key 排序
+func (s *Store) List(id string, prefix string) ([]KeyInfo, error) {
+	var keys []KeyInfo
+
+	err := s.Backend.Walk(path.Join(indexDir, id), func(name string, _ fs.FileInfo) error {
+		if isTempFile(path.Base(name)) {
+			return nil
+		}
+
+		f, err := s.Backend.Open(name)
+		if err != nil {
+			// 遍历期间被删除的记录
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+
+		var info KeyInfo
+		if err := json.NewDecoder(f).Decode(&info); err != nil {
+			return fmt.Errorf("corrupt index entry [%s]: %w", name, err)
+		}
+
+		if strings.HasPrefix(info.Key, prefix) {
+			keys = append(keys, info)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return io.Copy(f, r)
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	return keys, nil
+}
+
+// StoredHint 是替离线节点 Target 暂存的一个副本，ID、Key 和 Name 与 MessageStoreFile 中的含义相同
+type StoredHint struct {
+	Target string
+	ID     string
+	Key    string
+	Name   string
+	// CreatedAt 是文件写入的时间
+	CreatedAt time.Time
+}
+
+// hintNamespace 返回发给节点 target 的 id 的副本在存储中使用的命名空间
+func hintNamespace(target string, id string) string {
+	return path.Join(hintDir, target, id)
+}
+
+// WriteHint 和 WriteFull 一样从 r 中读取完整的 size 字节，作为发给节点 target 的副本暂存起来
+// 暂存的副本不会出现在 Keys、List 和反熵同步中
+func (s *Store) WriteHint(target string, id string, key string, name string, r io.Reader, size int64, meta Metadata) (int64, error) {
+	ns := hintNamespace(target, id)
+	n, _, err := s.writeBlob(ns, key, name, meta, copyFull(r, size), func(v objectVersion) (sidecar, error) {
+		return s.commit(ns, key, name, v)
+	})
+	return n, err
+}
+
+// ReadHint 打开暂存的副本，同时返回它的元数据
+func (s *Store) ReadHint(h StoredHint) (int64, io.ReadCloser, Metadata, error) {
+	return s.ReadWithMetadata(hintNamespace(h.Target, h.ID), h.Key)
+}
+
+// RemoveHint 删除暂存的副本
+func (s *Store) RemoveHint(h StoredHint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(hintNamespace(h.Target, h.ID), h.Key)
+}
+
+// Hints 返回存储中所有暂存的副本
+func (s *Store) Hints() ([]StoredHint, error) {
+	var hints []StoredHint
+
+	err := s.Backend.Walk(hintDir, func(name string, _ fs.FileInfo) error {
+		if !strings.HasSuffix(name, metaSuffix) || isTempFile(path.Base(name)) {
+			return nil
+		}
+
+		// hintDir/<target>/<id>/<path>
+		parts := strings.SplitN(name, "/", 4)
+		if len(parts) < 4 {
+			return nil
+		}
+
+		sc, err := s.readSidecar(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("skipping [%s]: %v\n", name, err)
+			return nil
+		}
+
+		hints = append(hints, StoredHint{
+			Target:    parts[1],
+			ID:        parts[2],
+			Key:       sc.Key,
+			Name:      sc.Name,
+			CreatedAt: sc.CreatedAt,
+		})
+
+		return nil
+	})
+
+	return hints, err
+}
+
+// RemoveTempFiles 删除上次运行时因为崩溃或者连接中断而遗留的临时文件，
+// 以及已经写入但没有提交到 sidecar 的数据文件，应该在启动时调用
+func (s *Store) RemoveTempFiles() error {
+	return s.Backend.Walk(".", func(name string, _ fs.FileInfo) error {
+		base := path.Base(name)
+
+		if isTempFile(base) {
+			log.Printf("removing orphaned temp file [%s]\n", name)
+			return s.Backend.Remove(name)
+		}
+
+		// 隔离区中的数据文件没有对应的 sidecar
+		i := strings.LastIndex(name, blobInfix)
+		if i < 0 || strings.HasPrefix(base, ".") || strings.HasPrefix(name, quarantineDir+"/") {
+			return nil
+		}
+
+		sc, err := s.readSidecar(name[:i] + metaSuffix)
+		if err == nil && slices.ContainsFunc(sc.versions(), func(v objectVersion) bool { return v.Blob == base }) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// 无法判断 sidecar 是否引用了这个数据文件，保留它
+			return nil
+		}
+
+		log.Printf("removing uncommitted data file [%s]\n", name)
+		return s.Backend.Remove(name)
+	})
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempFileInfix)
 }
@@ -2,10 +2,16 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -43,9 +49,547 @@ func TestStore(t *testing.T) {
 
 }
 
+func TestStoreDeleteKeepsNeighbours(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := generateID()
+
+	// 这两个 key 的 SHA-1 前 5 个字符相同，因此共享第一层目录
+	target, neighbour := "picture_75.png", "picture_1475.png"
+	assert.Equal(t, CASPathTransformFunc(target).FirstPathName(), CASPathTransformFunc(neighbour).FirstPathName())
+
+	for _, key := range []string{target, neighbour} {
+		_, err := s.Write(id, key, bytes.NewReader([]byte(key)))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, s.Delete(id, target))
+	assert.False(t, s.Has(id, target))
+	assert.True(t, s.Has(id, neighbour))
+
+	_, r, err := s.Read(id, neighbour)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, neighbour, string(b))
+
+	// 被删除文件独有的目录应该被清理掉，共享的第一层目录保留
+	targetDir := fmt.Sprintf("%s/%s/%s", s.Root, id, CASPathTransformFunc(target).PathName)
+	_, err = os.Stat(targetDir)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	firstDir := fmt.Sprintf("%s/%s/%s", s.Root, id, CASPathTransformFunc(target).FirstPathName())
+	_, err = os.Stat(firstDir)
+	assert.Nil(t, err)
+
+	// 删除最后一个文件后，id 下面的目录都会被清理
+	assert.Nil(t, s.Delete(id, neighbour))
+	entries, err := os.ReadDir(fmt.Sprintf("%s/%s", s.Root, id))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStoreDeleteNotFound(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	err := s.Delete(generateID(), "missing")
+
+	var notFound *KeyNotFoundError
+	assert.True(t, errors.As(err, &notFound))
+	assert.Equal(t, "missing", notFound.Key)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+// failingReader 先返回一部分数据，然后返回错误，模拟中途断开的连接
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestStoreWriteIsAtomic(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := generateID()
+	key := "picture.png"
+
+	_, err := s.Write(id, key, bytes.NewReader([]byte("old content")))
+	assert.Nil(t, err)
+
+	// 中途失败的写入不能覆盖原来的文件
+	_, err = s.Write(id, key, &failingReader{data: []byte("new")})
+	assert.NotNil(t, err)
+
+	_, r, err := s.Read(id, key)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, "old content", string(b))
+
+	// 收到的数据比预期少时不能提交文件
+	_, err = s.WriteFull(id, "truncated", "truncated", bytes.NewReader([]byte("short")), 100, Metadata{})
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.False(t, s.Has(id, "truncated"))
+
+	// 失败的写入不会留下临时文件，目录中只有 sidecar 和它引用的数据文件
+	dir := fmt.Sprintf("%s/%s/%s", s.Root, id, CASPathTransformFunc(key).PathName)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestStoreRemoveTempFiles(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := generateID()
+	key := "picture.png"
+
+	_, err := s.Write(id, key, bytes.NewReader([]byte("content")))
+	assert.Nil(t, err)
+
+	pathKey := CASPathTransformFunc(key)
+	orphan := fmt.Sprintf("%s/%s/%s/.%s%s123", s.Root, id, pathKey.PathName, pathKey.Filename, tempFileInfix)
+	assert.Nil(t, os.WriteFile(orphan, []byte("partial"), 0o644))
+
+	// 数据文件已经写入，但是 sidecar 还没有提交时崩溃
+	uncommitted := fmt.Sprintf("%s/%s/%s/%s%s0123456789abcdef", s.Root, id, pathKey.PathName, pathKey.Filename, blobInfix)
+	assert.Nil(t, os.WriteFile(uncommitted, []byte("uncommitted"), 0o644))
+
+	assert.Nil(t, s.RemoveTempFiles())
+
+	_, err = os.Stat(orphan)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = os.Stat(uncommitted)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	_, r, err := s.Read(id, key)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, "content", string(b))
+}
+
+func TestStoreMetadata(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	key := "video.mp4"
+
+	meta := Metadata{
+		ContentType: "video/mp4",
+		User:        map[string]string{"camera": "front"},
+	}
+	_, err := s.WriteWithMetadata(id, key, bytes.NewReader([]byte("frames")), meta)
+	assert.Nil(t, err)
+
+	size, r, got, err := s.ReadWithMetadata(id, key)
+	assert.Nil(t, err)
+	r.Close()
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, "video/mp4", got.ContentType)
+	assert.Equal(t, "front", got.User["camera"])
+	assert.Equal(t, "594cfd2607d4f09e1ce6241203e418cacfed545063792bc5eab7afaadbf0c4e0", got.Checksum)
+	assert.False(t, got.CreatedAt.IsZero())
+
+	// 覆盖写入时元数据和数据一起被替换，旧的数据文件被删除
+	_, err = s.Write(id, key, bytes.NewReader([]byte("new frames")))
+	assert.Nil(t, err)
+
+	got, err = s.Metadata(id, key)
+	assert.Nil(t, err)
+	assert.Empty(t, got.ContentType)
+
+	var files []string
+	s.Backend.Walk(id, func(name string, _ fs.FileInfo) error {
+		files = append(files, name)
+		return nil
+	})
+	assert.Len(t, files, 2)
+}
+
+func TestStoreList(t *testing.T) {
+	s := newStore()
+	id := generateID()
+
+	for _, key := range []string{"photos/b.png", "photos/a.png", "docs/readme.md"} {
+		_, err := s.Write(id, key, bytes.NewReader([]byte(key)))
+		assert.Nil(t, err)
+	}
+
+	// 副本上保存的是散列过的 key，索引中记录的是原始的 key
+	_, err := s.WriteFull(id, hashKey("photos/c.png"), "photos/c.png", bytes.NewReader([]byte("c")), 1, Metadata{})
+	assert.Nil(t, err)
+
+	keys, err := s.List(id, "photos/")
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, "photos/a.png", keys[0].Key)
+	assert.Equal(t, int64(len("photos/a.png")), keys[0].Size)
+	assert.Equal(t, "photos/c.png", keys[2].Key)
+	assert.Len(t, keys[0].Hash, 64)
+	assert.False(t, keys[0].ModTime.IsZero())
+
+	assert.Nil(t, s.Delete(id, "photos/a.png"))
+	keys, err = s.List(id, "")
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, "docs/readme.md", keys[0].Key)
+
+	keys, err = s.List(generateID(), "")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+// forgetTombstone 删除 key 的墓碑，模拟一个错过了删除的副本
+func forgetTombstone(t *testing.T, s *Store, id string, key string) {
+	assert.Nil(t, s.Backend.Remove(s.name(id, key)+tombstoneSuffix))
+}
+
+// corruptBlob 将 key 对应的数据文件的第一个字节取反，大小保持不变
+func corruptBlob(t *testing.T, s *Store, id string, key string) {
+	corruptVersion(t, s, id, key, "")
+}
+
+// corruptVersion 翻转 key 的版本 versionID 的数据文件的第一个字节，versionID 为空时是当前的版本
+func corruptVersion(t *testing.T, s *Store, id string, key string, versionID string) {
+	sc, err := s.sidecar(id, key)
+	assert.Nil(t, err)
+	v, ok := sc.version(versionID)
+	assert.True(t, ok)
+	blob := s.blobName(id, key, v.Blob)
+
+	f, err := s.Backend.Open(blob)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	assert.Nil(t, err)
+
+	data[0] ^= 0xff
+
+	w, err := s.Backend.Create(blob)
+	assert.Nil(t, err)
+	w.Write(data)
+	assert.Nil(t, w.Commit())
+}
+
+func TestStoreVerifyAndQuarantine(t *testing.T) {
+	s := newStore()
+	id := generateID()
+
+	for _, key := range []string{"good.txt", "bad.txt"} {
+		_, err := s.Write(id, key, strings.NewReader("content of "+key))
+		assert.Nil(t, err)
+	}
+
+	keys, err := s.Keys()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []StoredKey{
+		{ID: id, Key: "good.txt", Name: "good.txt"},
+		{ID: id, Key: "bad.txt", Name: "bad.txt"},
+	}, keys)
+
+	corruptBlob(t, s, id, "bad.txt")
+
+	n, err := s.Verify(id, "good.txt", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("content of good.txt")), n)
+
+	_, err = s.Verify(id, "bad.txt", nil)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+
+	// sidecar 中丢失了 SHA-256 的文件同样被当作损坏
+	sc, err := s.sidecar(id, "good.txt")
+	assert.Nil(t, err)
+	sc.Hash = ""
+	assert.Nil(t, s.writeSidecar(id, "good.txt", sc))
+	_, err = s.Verify(id, "good.txt", nil)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+
+	name, err := s.Quarantine(id, "bad.txt", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "bad.txt", name)
+	assert.False(t, s.Has(id, "bad.txt"))
+
+	// 被隔离的文件不再出现在存储和索引中
+	keys, err = s.Keys()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+
+	listed, err := s.List(id, "")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 1)
+
+	// 启动时的清理不会删除隔离区中的文件
+	assert.Nil(t, s.RemoveTempFiles())
+
+	var quarantined []string
+	s.Backend.Walk(quarantineDir, func(name string, _ fs.FileInfo) error {
+		quarantined = append(quarantined, name)
+		return nil
+	})
+	assert.Len(t, quarantined, 2)
+}
+
+func TestStoreVersions(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+		MaxVersions:       3,
+	})
+	id := generateID()
+	key := "report.pdf"
+
+	start := time.Now()
+	meta := func(i int) Metadata {
+		ts := Timestamp{Wall: start.Add(time.Duration(i) * time.Second).UnixNano(), Node: id}
+		return Metadata{CreatedAt: ts.Time(), VersionID: ts.String()}
+	}
+
+	for _, i := range []int{1, 2, 4} {
+		_, err := s.WriteWithMetadata(id, key, strings.NewReader(fmt.Sprintf("v%d", i)), meta(i))
+		assert.Nil(t, err)
+	}
+
+	// 写入一个比当前版本旧的版本，它按照先后顺序加入历史版本
+	_, err := s.WriteWithMetadata(id, key, strings.NewReader("v3"), meta(3))
+	assert.Nil(t, err)
+
+	versions, err := s.Versions(id, key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, meta(4).VersionID, versions[0].VersionID)
+	assert.True(t, versions[0].Latest)
+	assert.Equal(t, meta(3).VersionID, versions[1].VersionID)
+	assert.Equal(t, meta(2).VersionID, versions[2].VersionID)
+	assert.False(t, versions[2].Latest)
+
+	_, r, err := s.Read(id, key)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, "v4", string(b))
+
+	_, rc, got, err := s.ReadVersion(id, key, meta(2).VersionID)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "v2", string(b))
+	assert.Equal(t, meta(2).VersionID, got.VersionID)
+
+	// 超出保留数量的最旧的版本和它的数据文件被删除
+	assert.False(t, s.HasVersion(id, key, meta(1).VersionID))
+	_, _, _, err = s.ReadVersion(id, key, meta(1).VersionID)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	var files []string
+	s.Backend.Walk(id, func(name string, _ fs.FileInfo) error {
+		files = append(files, name)
+		return nil
+	})
+	assert.Len(t, files, 4)
+
+	// 删除文件时删除所有的版本
+	assert.Nil(t, s.Delete(id, key))
+	files = files[:0]
+	s.Backend.Walk(id, func(name string, _ fs.FileInfo) error {
+		files = append(files, name)
+		return nil
+	})
+	assert.Empty(t, files)
+}
+
+func TestStoreQuarantineVersion(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
+		MaxVersions:       3,
+	})
+	id := generateID()
+	key := "history.txt"
+
+	start := time.Now()
+	meta := func(i int) Metadata {
+		ts := Timestamp{Wall: start.Add(time.Duration(i) * time.Second).UnixNano(), Node: id}
+		return Metadata{CreatedAt: ts.Time(), VersionID: ts.String()}
+	}
+	for i := 1; i <= 3; i++ {
+		_, err := s.WriteWithMetadata(id, key, strings.NewReader(fmt.Sprintf("v%d", i)), meta(i))
+		assert.Nil(t, err)
+	}
+
+	readVersion := func(versionID string) string {
+		_, r, _, err := s.ReadVersion(id, key, versionID)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		defer r.Close()
+		b, _ := io.ReadAll(r)
+		return string(b)
+	}
+
+	// 损坏的旧版本被隔离，其他版本保留下来
+	corruptVersion(t, s, id, key, meta(2).VersionID)
+	_, err := s.VerifyVersion(id, key, meta(2).VersionID, nil)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+	_, err = s.VerifyVersion(id, key, meta(1).VersionID, nil)
+	assert.Nil(t, err)
+
+	name, err := s.Quarantine(id, key, meta(2).VersionID)
+	assert.Nil(t, err)
+	assert.Equal(t, key, name)
+	assert.False(t, s.HasVersion(id, key, meta(2).VersionID))
+
+	versions, err := s.Versions(id, key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "v3", readVersion(""))
+	assert.Equal(t, "v1", readVersion(meta(1).VersionID))
+	for _, v := range versions {
+		_, err := s.VerifyVersion(id, key, v.VersionID, nil)
+		assert.Nil(t, err)
+	}
+
+	// 隔离当前的版本之后，最新的旧版本成为当前的版本，索引也跟着更新
+	corruptVersion(t, s, id, key, "")
+	_, err = s.Quarantine(id, key, "")
+	assert.Nil(t, err)
+	assert.True(t, s.Has(id, key))
+	assert.Equal(t, "v1", readVersion(""))
+
+	listed, err := s.List(id, "")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 1)
+	assert.Equal(t, int64(len("v1")), listed[0].Size)
+
+	// 重新获取的版本按照先后回到原来的位置
+	_, err = s.WriteWithMetadata(id, key, strings.NewReader("v2"), meta(2))
+	assert.Nil(t, err)
+	_, err = s.WriteWithMetadata(id, key, strings.NewReader("v3"), meta(3))
+	assert.Nil(t, err)
+	versions, err = s.Versions(id, key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, meta(3).VersionID, versions[0].VersionID)
+	assert.Equal(t, "v2", readVersion(meta(2).VersionID))
+
+	var quarantined []string
+	s.Backend.Walk(quarantineDir, func(name string, _ fs.FileInfo) error {
+		quarantined = append(quarantined, name)
+		return nil
+	})
+	assert.Len(t, quarantined, 4)
+}
+
+func TestStoreHints(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	target, id := generateID(), generateID()
+
+	_, err := s.WriteHint(target, id, hashKey("a.txt"), "a.txt", strings.NewReader("hinted"), 6, Metadata{})
+	assert.Nil(t, err)
+
+	// 暂存的副本不属于任何 ID，不会出现在 Keys 和 List 中
+	keys, err := s.Keys()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+	listed, err := s.List(id, "")
+	assert.Nil(t, err)
+	assert.Empty(t, listed)
+
+	// 重新启动之后暂存的副本依然存在
+	s = NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	assert.Nil(t, s.RemoveTempFiles())
+
+	hints, err := s.Hints()
+	assert.Nil(t, err)
+	assert.Len(t, hints, 1)
+	assert.Equal(t, target, hints[0].Target)
+	assert.Equal(t, id, hints[0].ID)
+	assert.Equal(t, "a.txt", hints[0].Name)
+	assert.False(t, hints[0].CreatedAt.IsZero())
+
+	size, r, _, err := s.ReadHint(hints[0])
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, "hinted", string(b))
+
+	assert.Nil(t, s.RemoveHint(hints[0]))
+	hints, err = s.Hints()
+	assert.Nil(t, err)
+	assert.Empty(t, hints)
+}
+
+func TestStoreTombstones(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	key := hashKey("deleted.txt")
+
+	deletedAt := NewHLC(id).Now()
+	assert.Nil(t, s.WriteTombstone(id, key, deletedAt))
+
+	got, ok := s.Tombstone(id, key)
+	assert.True(t, ok)
+	assert.Equal(t, deletedAt.String(), got.String())
+
+	tombstones, err := s.Tombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, []StoredTombstone{{ID: id, Key: key, DeletedAt: got}}, tombstones)
+
+	// 损坏的墓碑不会被当作不存在而跳过
+	w, err := s.Backend.Create(s.name(id, hashKey("corrupt.txt")) + tombstoneSuffix)
+	assert.Nil(t, err)
+	w.Write([]byte("2024-01-01T00:00:00Z"))
+	assert.Nil(t, w.Commit())
+
+	_, err = s.Tombstones()
+	assert.NotNil(t, err)
+
+	// 比墓碑旧的版本不会被提交
+	clock := NewHLC(id)
+	old := clock.Now()
+	deletedAt = clock.Now()
+	assert.Nil(t, s.WriteTombstone(id, key, deletedAt))
+	_, err = s.WriteWithMetadata(id, key, strings.NewReader("old"), Metadata{CreatedAt: old.Time(), VersionID: old.String()})
+	assert.ErrorIs(t, err, ErrStaleWrite)
+	assert.False(t, s.Has(id, key))
+
+	// 删除之后重新写入的文件不会被这次删除删掉，更旧的墓碑也不会覆盖更新的墓碑
+	newer := clock.Now()
+	_, err = s.WriteWithMetadata(id, key, strings.NewReader("new"), Metadata{CreatedAt: newer.Time(), VersionID: newer.String()})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, s.WriteTombstone(id, key, deletedAt), ErrStaleWrite)
+	assert.True(t, s.Has(id, key))
+	_, ok = s.Tombstone(id, key)
+	assert.False(t, ok)
+
+	latest := clock.Now()
+	assert.Nil(t, s.WriteTombstone(id, key, latest))
+	assert.Nil(t, s.WriteTombstone(id, key, deletedAt))
+	assert.False(t, s.Has(id, key))
+	got, _ = s.Tombstone(id, key)
+	assert.Equal(t, latest.String(), got.String())
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
+		Backend:           NewMemoryBackend(),
 	}
 
 	return NewStore(opts)
@@ -56,3 +600,34 @@ func teardown(t *testing.T, s *Store) {
 		t.Error(err)
 	}
 }
+
+func TestTombstoneSerializedWithStore(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	clock := NewHLC(id)
+
+	// 并发的删除和更新的写入无论谁先完成，最后都保留更新的文件
+	for i := 0; i < 50; i++ {
+		key := hashKey(fmt.Sprintf("race_%d.txt", i))
+		deletedAt, newer := clock.Now(), clock.Now()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := s.WriteTombstone(id, key, deletedAt)
+			assert.True(t, err == nil || errors.Is(err, ErrStaleWrite))
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.WriteWithMetadata(id, key, strings.NewReader("new"), Metadata{CreatedAt: newer.Time(), VersionID: newer.String()})
+			assert.Nil(t, err)
+		}()
+		wg.Wait()
+
+		assert.True(t, s.Has(id, key))
+		_, deleted := s.Tombstone(id, key)
+		assert.False(t, deleted)
+	}
+	assert.Empty(t, s.keyLocks)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"distributed-file-store/p2p"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// defaultMaxVersions 是每个文件默认保留的版本数量，包括当前的版本
+const defaultMaxVersions = 10
+
+// MessageListVersions 请求对端列出它保存的 (ID, Key) 的所有版本
+type MessageListVersions struct {
+	ID        string
+	Key       string
+	RequestID string
+}
+
+// MessageListVersionsResponse 是对 MessageListVersions 的响应
+type MessageListVersionsResponse struct {
+	RequestID string
+	Versions  []VersionInfo
+	Err       string
+}
+
+// getVersion 获取文件的版本 versionID，本地没有这个版本时从网络上的对端获取
+// 获取到的旧版本按照版本的先后加入本地的历史版本，不会替换当前的版本
+func (s *FileServer) getVersion(key string, versionID string) (io.Reader, Metadata, error) {
+	if !s.store.HasVersion(s.ID, key, versionID) {
+		fmt.Printf("[%s] dont have version (%s) of file (%s) locally, fetching from network...\n", s.Transport.Addr(), versionID, key)
+
+		// 本地没有这个文件时先获取当前的版本，否则获取到的旧版本会被当成当前的版本
+		if !s.store.Has(s.ID, key) {
+			if err := s.fetch(key, ""); err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+
+		if !s.store.HasVersion(s.ID, key, versionID) {
+			if err := s.fetch(key, versionID); err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+	}
+
+	_, r, meta, err := s.store.ReadVersion(s.ID, key, versionID)
+	if errors.Is(err, os.ErrNotExist) {
+		// 获取到的版本比本地保留的版本都旧，已经被丢弃
+		return nil, Metadata{}, fmt.Errorf("[%s] version (%s) of file (%s) is beyond retention: %w", s.Transport.Addr(), versionID, key, ErrFileNotFound)
+	}
+
+	return r, meta, err
+}
+
+// ListVersions 列出文件在集群中保留的所有版本，合并本地和所有对端的结果，从新到旧排列
+func (s *FileServer) ListVersions(key string) ([]VersionInfo, error) {
+	if _, deleted := s.store.Tombstone(s.ID, key); deleted {
+		return nil, fmt.Errorf("[%s] file (%s) has been deleted: %w", s.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	merged := make(map[string]VersionInfo)
+
+	local, err := s.store.Versions(s.ID, key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, v := range local {
+		merged[v.VersionID] = v
+	}
+
+	if peers := s.connectedPeers(); len(peers) > 0 {
+		remote, err := s.listVersionsFrom(key, peers)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range remote {
+			if _, ok := merged[v.VersionID]; ok {
+				continue
+			}
+			// 对端保存的是加密后的文件，返回明文的大小
+			if v.Size, err = decryptedSize(v.Size); err != nil {
+				continue
+			}
+			merged[v.VersionID] = v
+		}
+	}
+
+	if len(merged) == 0 {
+		return nil, fmt.Errorf("[%s] file (%s) not found: %w", s.Transport.Addr(), key, ErrFileNotFound)
+	}
+
+	versions := make([]VersionInfo, 0, len(merged))
+	for _, v := range merged {
+		v.Latest = false
+		versions = append(versions, v)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		a := Metadata{CreatedAt: versions[i].CreatedAt, VersionID: versions[i].VersionID}
+		return a.newerThan(Metadata{CreatedAt: versions[j].CreatedAt, VersionID: versions[j].VersionID})
+	})
+	versions[0].Latest = true
+
+	return versions, nil
+}
+
+// listVersionsFrom 向一组对端请求文件的版本列表，返回所有对端结果的并集
+func (s *FileServer) listVersionsFrom(key string, peers []p2p.Peer) ([]VersionInfo, error) {
+	req := s.addPendingRequest(len(peers))
+	defer s.removePendingRequest(req)
+
+	msg := Message{
+		Payload: MessageListVersions{
+			ID:        s.ID,
+			Key:       hashKey(key),
+			RequestID: req.id,
+		},
+	}
+
+	if err := s.multicast(peers, &msg); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	var (
+		versions []VersionInfo
+		errs     []error
+	)
+	for received := 0; received < len(peers); received++ {
+		select {
+		case v := <-req.respCh:
+			resp := v.(MessageListVersionsResponse)
+			if resp.Err != "" {
+				errs = append(errs, errors.New(resp.Err))
+				continue
+			}
+			versions = append(versions, resp.Versions...)
+		case <-timer.C:
+			return nil, fmt.Errorf("[%s] timed out listing versions of (%s): %d of %d peers responded", s.Transport.Addr(), key, received, len(peers))
+		case <-s.quitCh:
+			return nil, fmt.Errorf("[%s] file server stopped", s.Transport.Addr())
+		}
+	}
+
+	return versions, errors.Join(errs...)
+}
+
+func (s *FileServer) handleMessageListVersions(from string, msg MessageListVersions) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	resp := MessageListVersionsResponse{RequestID: msg.RequestID}
+
+	versions, err := s.store.Versions(msg.ID, msg.Key)
+	switch {
+	case err == nil:
+		resp.Versions = versions
+	case !errors.Is(err, os.ErrNotExist):
+		resp.Err = fmt.Sprintf("[%s] list versions (%s): %v", s.Transport.Addr(), msg.Key, err)
+	}
+
+	return s.send(peer, &Message{Payload: resp})
+}
+
+func (s *FileServer) handleMessageListVersionsResponse(from string, msg MessageListVersionsResponse) error {
+	if req, ok := s.pendingRequest(msg.RequestID); ok {
+		req.deliver(msg)
+	}
+
+	return nil
+}
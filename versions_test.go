@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersions(t *testing.T) {
+	a := makeTestServer(t, "127.0.0.1:30981", withNodes("127.0.0.1:30982"))
+	b := makeTestServer(t, "127.0.0.1:30982")
+	a.WriteQuorum = 2
+
+	startCluster(t, b, a)
+
+	key := "notes.txt"
+	first, err := a.StoreWithMetadata(key, strings.NewReader("first draft"), Metadata{})
+	assert.Nil(t, err)
+	second, err := a.StoreWithMetadata(key, strings.NewReader("second draft"), Metadata{})
+	assert.Nil(t, err)
+	assert.Greater(t, second, first)
+
+	read := func(version ...string) string {
+		r, meta, err := a.Get(key, version...)
+		assert.Nil(t, err)
+		if err != nil {
+			return ""
+		}
+		data, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if len(version) > 0 {
+			assert.Equal(t, version[0], meta.VersionID)
+		}
+		return string(data)
+	}
+
+	assert.Equal(t, "second draft", read())
+	assert.Equal(t, "first draft", read(first))
+
+	versions, err := a.ListVersions(key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, second, versions[0].VersionID)
+	assert.True(t, versions[0].Latest)
+	assert.Equal(t, first, versions[1].VersionID)
+	assert.Equal(t, int64(len("first draft")), versions[1].Size)
+
+	// 副本上也保留了旧的版本，本地丢失之后可以从副本获取
+	assert.True(t, b.store.HasVersion(a.ID, hashKey(key), first))
+	assert.Nil(t, a.store.Delete(a.ID, key))
+	assert.Equal(t, "first draft", read(first))
+
+	// 获取旧版本不会改变当前的版本
+	versions, err = a.ListVersions(key)
+	assert.Nil(t, err)
+	assert.Equal(t, second, versions[0].VersionID)
+	assert.Equal(t, "second draft", read())
+
+	// 副本收到的版本推进了它的时钟，之后 b 生成的版本排在 a 的版本之后
+	assert.Greater(t, b.clock.Now().String(), second)
+}